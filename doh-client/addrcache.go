@@ -0,0 +1,233 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m13253/dns-over-https/internal/backoff"
+	"github.com/miekg/dns"
+)
+
+const (
+	// addresses are refreshed when their TTL expires, but not more often
+	// than minAddrRefresh and not less often than maxAddrRefresh
+	minAddrRefresh = 30 * time.Second
+	maxAddrRefresh = time.Hour
+)
+
+// upstreamAddrs resolves the hostnames of upstreams through the bootstrap
+// servers ahead of time and refreshes them when their TTL expires. New
+// connections are made to the fresh addresses, so an upstream moving its
+// anycast or load balancer addresses does not cause a burst of failures until
+// the OS cache catches up.
+type upstreamAddrs struct {
+	mu        sync.RWMutex
+	addrs     map[string][]net.IP
+	client    *dns.Client
+	bootstrap []string
+	noIPv6    bool
+	verbose   bool
+	// changed is called when the addresses of a host changed
+	changed func()
+}
+
+func newUpstreamAddrs(bootstrap []string, timeout time.Duration, noIPv6, verbose bool, changed func()) *upstreamAddrs {
+	return &upstreamAddrs{
+		addrs:     make(map[string][]net.IP),
+		client:    &dns.Client{Net: "udp", Timeout: timeout},
+		bootstrap: bootstrap,
+		noIPv6:    noIPv6,
+		verbose:   verbose,
+		changed:   changed,
+	}
+}
+
+// start refreshes the hostnames of upstreamURLs in the background, IP
+// literals are skipped
+func (ua *upstreamAddrs) start(upstreamURLs []string) {
+	hosts := make(map[string]bool)
+	for _, upstreamURL := range upstreamURLs {
+		u, err := url.Parse(upstreamURL)
+		if err != nil || u.Hostname() == "" || net.ParseIP(u.Hostname()) != nil {
+			continue
+		}
+		hosts[strings.ToLower(u.Hostname())] = true
+	}
+	for host := range hosts {
+		go ua.refreshLoop(host)
+	}
+}
+
+func (ua *upstreamAddrs) refreshLoop(host string) {
+	retry := &backoff.Backoff{
+		Base:   5 * time.Second,
+		Max:    minAddrRefresh,
+		Factor: 2,
+	}
+	for {
+		ips, ttl, err := ua.resolve(host)
+		if err != nil {
+			log.Printf("Failed to refresh the addresses of %s: %v\n", host, err)
+			retry.Wait(context.Background())
+			continue
+		}
+		retry.Reset()
+		ua.update(host, ips)
+
+		refresh := time.Duration(ttl) * time.Second
+		if refresh < minAddrRefresh {
+			refresh = minAddrRefresh
+		} else if refresh > maxAddrRefresh {
+			refresh = maxAddrRefresh
+		}
+		time.Sleep(refresh)
+	}
+}
+
+func (ua *upstreamAddrs) update(host string, ips []net.IP) {
+	ua.mu.Lock()
+	old, existed := ua.addrs[host]
+	ua.addrs[host] = ips
+	ua.mu.Unlock()
+
+	if !existed || sameIPs(old, ips) {
+		return
+	}
+	if ua.verbose {
+		log.Printf("Addresses of %s changed to %v\n", host, ips)
+	}
+	if ua.changed != nil {
+		ua.changed()
+	}
+}
+
+// resolve looks up the A and AAAA records of host, ttl is the least TTL of
+// them. It only fails if all lookups failed, a host may well have working
+// IPv4 while the AAAA lookup fails or the other way round.
+func (ua *upstreamAddrs) resolve(host string) (ips []net.IP, ttl uint32, err error) {
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+	if ua.noIPv6 {
+		qtypes = qtypes[:1]
+	}
+	ttl = uint32(maxAddrRefresh / time.Second)
+	failures := 0
+	for _, qtype := range qtypes {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(host), qtype)
+		server := ua.bootstrap[rand.Intn(len(ua.bootstrap))]
+		var reply *dns.Msg
+		reply, _, err = ua.client.Exchange(msg, server)
+		if err == nil && reply.Truncated {
+			tcpClient := &dns.Client{
+				Net:     "tcp",
+				Timeout: ua.client.Timeout,
+			}
+			reply, _, err = tcpClient.Exchange(msg, server)
+		}
+		if err != nil {
+			failures++
+			continue
+		}
+		for _, rr := range reply.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A)
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA)
+			default:
+				continue
+			}
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	}
+	if failures == len(qtypes) {
+		return nil, 0, err
+	}
+	if len(ips) == 0 {
+		return nil, 0, errors.New("no addresses found")
+	}
+	return ips, ttl, nil
+}
+
+func (ua *upstreamAddrs) lookup(host string) []net.IP {
+	ua.mu.RLock()
+	defer ua.mu.RUnlock()
+	return ua.addrs[strings.ToLower(host)]
+}
+
+// dialContext wraps dial, connecting to the prefetched addresses of the host
+// in order. Hosts not resolved yet are dialed as usual.
+func (ua *upstreamAddrs) dialContext(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return dial(ctx, network, address)
+		}
+		ips := ua.lookup(host)
+		if len(ips) == 0 {
+			return dial(ctx, network, address)
+		}
+		for _, ip := range ips {
+			var conn net.Conn
+			conn, err = dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, err
+	}
+}
+
+// sameIPs compares a and b ignoring the order, since many servers rotate
+// their answers
+func sameIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]int, len(a))
+	for _, ip := range a {
+		seen[ip.String()]++
+	}
+	for _, ip := range b {
+		if seen[ip.String()] == 0 {
+			return false
+		}
+		seen[ip.String()]--
+	}
+	return true
+}
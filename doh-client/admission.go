@@ -0,0 +1,108 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/m13253/dns-over-https/metrics"
+	"github.com/miekg/dns"
+)
+
+var (
+	inflightQueries = metrics.NewGauge(
+		"doh_client_inflight_queries",
+		"Number of queries waiting for an upstream response.",
+	)
+	loadShedding = metrics.NewGauge(
+		"doh_client_load_shedding",
+		"Whether doh-client is shedding load: 0 = no, 1 = low priority queries, 2 = all queries.",
+	)
+	shedQueries = metrics.NewCounter(
+		"doh_client_shed_queries_total",
+		"Number of queries refused because too many queries are in flight.",
+		"qtype",
+	)
+)
+
+// admissionControl bounds the number of queries waiting for upstream.
+//
+// When upstream latency spikes, queries pile up instead of finishing, so the
+// number of queries in flight is used as the signal of overload.
+type admissionControl struct {
+	shedInflight     int32
+	maxInflight      int32
+	lowPriorityTypes map[uint16]bool
+	inflight         int32
+}
+
+func newAdmissionControl(shedInflight, maxInflight uint, lowPriorityTypes []string) (*admissionControl, error) {
+	ac := &admissionControl{
+		shedInflight:     int32(shedInflight),
+		maxInflight:      int32(maxInflight),
+		lowPriorityTypes: make(map[uint16]bool, len(lowPriorityTypes)),
+	}
+	for _, typeStr := range lowPriorityTypes {
+		qtype, ok := dns.StringToType[strings.ToUpper(typeStr)]
+		if !ok {
+			return nil, fmt.Errorf("unknown record type %q in low_priority_types", typeStr)
+		}
+		ac.lowPriorityTypes[qtype] = true
+	}
+	return ac, nil
+}
+
+// admit reports whether a query of qtype may be sent upstream. If it returns
+// true, release must be called after the query finishes.
+func (ac *admissionControl) admit(qtype uint16) bool {
+	inflight := atomic.AddInt32(&ac.inflight, 1)
+	switch {
+	case ac.maxInflight != 0 && inflight > ac.maxInflight:
+		loadShedding.Set(2)
+	case ac.shedInflight != 0 && inflight > ac.shedInflight:
+		loadShedding.Set(1)
+		if !ac.lowPriorityTypes[qtype] {
+			inflightQueries.Set(float64(inflight))
+			return true
+		}
+	default:
+		loadShedding.Set(0)
+		inflightQueries.Set(float64(inflight))
+		return true
+	}
+	atomic.AddInt32(&ac.inflight, -1)
+	qtypeStr, ok := dns.TypeToString[qtype]
+	if !ok {
+		qtypeStr = "other"
+	}
+	shedQueries.Inc(qtypeStr)
+	return false
+}
+
+func (ac *admissionControl) release() {
+	inflight := atomic.AddInt32(&ac.inflight, -1)
+	inflightQueries.Set(float64(inflight))
+}
@@ -0,0 +1,113 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+// Package certcheck records the expiry time of certificates presented by
+// upstream servers, so that an expiring certificate on a self-hosted resolver
+// is noticed before queries start to fail.
+package certcheck
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/m13253/dns-over-https/metrics"
+)
+
+var certExpiry = metrics.NewGauge(
+	"doh_client_upstream_cert_expiry_timestamp_seconds",
+	"The notAfter time of the certificate presented by an upstream server, in Unix seconds.",
+	"subject",
+)
+
+type Checker struct {
+	warnBefore time.Duration
+	mu         sync.Mutex
+	lastWarned map[string]time.Time
+}
+
+// New creates a Checker that logs a warning when a certificate will expire
+// within warnBefore.
+func New(warnBefore time.Duration) *Checker {
+	return &Checker{
+		warnBefore: warnBefore,
+		lastWarned: make(map[string]time.Time),
+	}
+}
+
+// TLSConfig returns a new tls.Config which reports every verified handshake to
+// the Checker.
+func (c *Checker) TLSConfig() *tls.Config {
+	return &tls.Config{
+		VerifyPeerCertificate: c.verifyPeerCertificate,
+	}
+}
+
+// verifyPeerCertificate is called after the normal certificate verification,
+// it only observes the certificate and never rejects it.
+func (c *Checker) verifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	var leaf *x509.Certificate
+	if len(verifiedChains) != 0 && len(verifiedChains[0]) != 0 {
+		leaf = verifiedChains[0][0]
+	} else if len(rawCerts) != 0 {
+		var err error
+		leaf, err = x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return nil
+		}
+	} else {
+		return nil
+	}
+	c.Observe(leaf)
+	return nil
+}
+
+// Observe records the expiry time of cert, and warns at most once a day per
+// certificate subject if it is about to expire.
+func (c *Checker) Observe(cert *x509.Certificate) {
+	subject := cert.Subject.CommonName
+	if subject == "" && len(cert.DNSNames) != 0 {
+		subject = cert.DNSNames[0]
+	}
+	certExpiry.Set(float64(cert.NotAfter.Unix()), subject)
+
+	remaining := time.Until(cert.NotAfter)
+	if remaining >= c.warnBefore {
+		return
+	}
+	c.mu.Lock()
+	lastWarned, ok := c.lastWarned[subject]
+	if ok && time.Since(lastWarned) < 24*time.Hour {
+		c.mu.Unlock()
+		return
+	}
+	c.lastWarned[subject] = time.Now()
+	c.mu.Unlock()
+	if remaining <= 0 {
+		log.Printf("Warning: certificate of upstream %q has expired on %s\n", subject, cert.NotAfter.Format(time.RFC1123))
+	} else {
+		log.Printf("Warning: certificate of upstream %q will expire on %s (in %s)\n", subject, cert.NotAfter.Format(time.RFC1123), remaining.Truncate(time.Minute))
+	}
+}
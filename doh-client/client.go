@@ -26,6 +26,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
@@ -35,14 +36,20 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/m13253/dns-over-https/doh-client/certcheck"
 	"github.com/m13253/dns-over-https/doh-client/config"
+	"github.com/m13253/dns-over-https/doh-client/rrl"
 	"github.com/m13253/dns-over-https/doh-client/selector"
+	"github.com/m13253/dns-over-https/internal/dnsutil"
+	"github.com/m13253/dns-over-https/internal/ratelimit"
 	"github.com/m13253/dns-over-https/json-dns"
+	"github.com/m13253/dns-over-https/metrics"
+	"github.com/m13253/dns-over-https/stats"
 	"github.com/miekg/dns"
 	"golang.org/x/net/http2"
-	"golang.org/x/net/idna"
 )
 
 type Client struct {
@@ -58,8 +65,20 @@ type Client struct {
 	httpClientMux        *sync.RWMutex
 	httpTransport        *http.Transport
 	httpClient           *http.Client
+	dialContext          selector.DialContextFunc // shared by queries and probes
 	httpClientLastCreate time.Time
 	selector             selector.Selector
+	certChecker          *certcheck.Checker
+	rrl                  *rrl.Limiter
+	admission            *admissionControl
+	mirror               *queryMirror
+	report               *reportCollector
+	stats                stats.Stats
+	answerRotation       uint32
+	startedServers       int32
+	pacer                *ratelimit.Bucket
+	upstreamAddrs        *upstreamAddrs
+	compression          *compressionPolicy
 }
 
 type DNSRequest struct {
@@ -74,8 +93,12 @@ type DNSRequest struct {
 
 func NewClient(conf *config.Config) (c *Client, err error) {
 	c = &Client{
-		conf: conf,
+		conf:        conf,
+		certChecker: certcheck.New(time.Duration(conf.Other.CertExpiryWarningDays) * 24 * time.Hour),
+		report:      newReportCollector(),
+		compression: newCompressionPolicy(conf),
 	}
+	c.stats = stats.Multi(metrics.NewStats("doh_client"), c.report)
 
 	udpHandler := dns.HandlerFunc(c.udpHandlerFunc)
 	tcpHandler := dns.HandlerFunc(c.tcpHandlerFunc)
@@ -90,17 +113,29 @@ func NewClient(conf *config.Config) (c *Client, err error) {
 	}
 	for _, addr := range conf.Listen {
 		c.udpServers = append(c.udpServers, &dns.Server{
-			Addr:    addr,
-			Net:     "udp",
-			Handler: udpHandler,
-			UDPSize: dns.DefaultMsgSize,
+			Addr:              addr,
+			Net:               "udp",
+			Handler:           udpHandler,
+			UDPSize:           dns.DefaultMsgSize,
+			DecorateReader:    c.decorateReader,
+			NotifyStartedFunc: c.serverStarted,
 		})
 		c.tcpServers = append(c.tcpServers, &dns.Server{
-			Addr:    addr,
-			Net:     "tcp",
-			Handler: tcpHandler,
+			Addr:              addr,
+			Net:               "tcp",
+			Handler:           tcpHandler,
+			DecorateReader:    c.decorateReader,
+			IdleTimeout:       c.tcpIdleTimeout,
+			NotifyStartedFunc: c.serverStarted,
 		})
 	}
+	if conf.RateLimit.ResponsesPerSecond != 0 {
+		c.rrl = rrl.New(conf.RateLimit.ResponsesPerSecond, conf.RateLimit.Window, conf.RateLimit.Slip, conf.RateLimit.Leak, conf.RateLimit.IPv4PrefixLength, conf.RateLimit.IPv6PrefixLength)
+	}
+	c.admission, err = newAdmissionControl(conf.LoadShedding.ShedInflight, conf.LoadShedding.MaxInflight, conf.LoadShedding.LowPriorityTypes)
+	if err != nil {
+		return nil, err
+	}
 	c.bootstrapResolver = net.DefaultResolver
 	if len(conf.Other.Bootstrap) != 0 {
 		c.bootstrap = make([]string, len(conf.Other.Bootstrap))
@@ -127,10 +162,7 @@ func NewClient(conf *config.Config) (c *Client, err error) {
 		if len(conf.Other.Passthrough) != 0 {
 			c.passthrough = make([]string, len(conf.Other.Passthrough))
 			for i, passthrough := range conf.Other.Passthrough {
-				if punycode, err := idna.ToASCII(passthrough); err != nil {
-					passthrough = punycode
-				}
-				c.passthrough[i] = "." + strings.ToLower(strings.Trim(passthrough, ".")) + "."
+				c.passthrough[i] = "." + strings.Trim(dnsutil.CanonicalName(passthrough), ".") + "."
 			}
 		}
 	}
@@ -146,6 +178,29 @@ func NewClient(conf *config.Config) (c *Client, err error) {
 		c.cookieJar = nil
 	}
 
+	if conf.Upstream.PacingRate != 0 {
+		c.pacer = ratelimit.NewBucket(conf.Upstream.PacingRate, float64(conf.Upstream.PacingBurst))
+	}
+	if conf.Mirror.Percent > 0 {
+		c.mirror, err = newQueryMirror(conf.Mirror.URL, conf.Mirror.Address, conf.Mirror.Percent, time.Duration(conf.Other.Timeout)*time.Second, c.bootstrapResolver, c.certChecker.TLSConfig())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.Upstream.PrefetchAddresses {
+		if len(c.bootstrap) == 0 {
+			log.Println("WARNING: prefetch_addresses requires bootstrap servers, ignored")
+		} else {
+			c.upstreamAddrs = newUpstreamAddrs(c.bootstrap, time.Duration(conf.Other.Timeout)*time.Second, conf.Other.NoIPv6, conf.Other.Verbose, func() {
+				c.httpClientMux.RLock()
+				c.httpTransport.CloseIdleConnections()
+				c.httpClientMux.RUnlock()
+			})
+		}
+	}
+
+	c.dialContext = c.newDialContext()
 	c.httpClientMux = new(sync.RWMutex)
 	err = c.newHTTPClient()
 	if err != nil {
@@ -158,15 +213,23 @@ func NewClient(conf *config.Config) (c *Client, err error) {
 			log.Println(config.NginxWRR, "mode start")
 		}
 
-		s := selector.NewNginxWRRSelector(time.Duration(c.conf.Other.Timeout) * time.Second)
+		s := selector.NewNginxWRRSelector(time.Duration(c.conf.Other.Timeout)*time.Second, c.certChecker.TLSConfig(), c.dialContext)
 		for _, u := range c.conf.Upstream.UpstreamGoogle {
-			if err := s.Add(u.URL, selector.Google, u.Weight); err != nil {
+			probe, err := selector.NewProbe(u.Probe, c.certChecker.TLSConfig(), c.dialContext)
+			if err != nil {
+				return nil, err
+			}
+			if err := s.Add(u.URL, selector.Google, u.Weight, probe, time.Duration(u.ProbeInterval)*time.Second); err != nil {
 				return nil, err
 			}
 		}
 
 		for _, u := range c.conf.Upstream.UpstreamIETF {
-			if err := s.Add(u.URL, selector.IETF, u.Weight); err != nil {
+			probe, err := selector.NewProbe(u.Probe, c.certChecker.TLSConfig(), c.dialContext)
+			if err != nil {
+				return nil, err
+			}
+			if err := s.Add(u.URL, selector.IETF, u.Weight, probe, time.Duration(u.ProbeInterval)*time.Second); err != nil {
 				return nil, err
 			}
 		}
@@ -178,15 +241,23 @@ func NewClient(conf *config.Config) (c *Client, err error) {
 			log.Println(config.LVSWRR, "mode start")
 		}
 
-		s := selector.NewLVSWRRSelector(time.Duration(c.conf.Other.Timeout) * time.Second)
+		s := selector.NewLVSWRRSelector(time.Duration(c.conf.Other.Timeout)*time.Second, c.certChecker.TLSConfig(), c.dialContext)
 		for _, u := range c.conf.Upstream.UpstreamGoogle {
-			if err := s.Add(u.URL, selector.Google, u.Weight); err != nil {
+			probe, err := selector.NewProbe(u.Probe, c.certChecker.TLSConfig(), c.dialContext)
+			if err != nil {
+				return nil, err
+			}
+			if err := s.Add(u.URL, selector.Google, u.Weight, probe, time.Duration(u.ProbeInterval)*time.Second); err != nil {
 				return nil, err
 			}
 		}
 
 		for _, u := range c.conf.Upstream.UpstreamIETF {
-			if err := s.Add(u.URL, selector.IETF, u.Weight); err != nil {
+			probe, err := selector.NewProbe(u.Probe, c.certChecker.TLSConfig(), c.dialContext)
+			if err != nil {
+				return nil, err
+			}
+			if err := s.Add(u.URL, selector.IETF, u.Weight, probe, time.Duration(u.ProbeInterval)*time.Second); err != nil {
 				return nil, err
 			}
 		}
@@ -215,15 +286,55 @@ func NewClient(conf *config.Config) (c *Client, err error) {
 		c.selector = s
 	}
 
+	if c.conf.Upstream.PenaltyHalfLife != 0 {
+		if decayer, ok := c.selector.(selector.PenaltyDecayer); ok {
+			decayer.SetPenaltyHalfLife(time.Duration(c.conf.Upstream.PenaltyHalfLife) * time.Second)
+		}
+	}
+
+	if c.conf.Upstream.PrewarmConnections {
+		if prewarmer, ok := c.selector.(selector.Prewarmer); ok {
+			prewarmer.SetPrewarmFunc(c.prewarmUpstream)
+		}
+	}
+
 	if c.conf.Other.Verbose {
 		if reporter, ok := c.selector.(selector.DebugReporter); ok {
 			reporter.ReportWeights()
 		}
+		if logger, ok := c.selector.(selector.DecisionLogger); ok {
+			logger.SetDecisionLogSampleRate(c.conf.Upstream.DecisionLogSampleRate)
+		}
 	}
 
 	return c, nil
 }
 
+// newDialContext returns the function opening connections to upstreams, both
+// for queries and for probes: through the bootstrap resolver, over IPv4 only
+// if no_ipv6 is set, and to the prefetched addresses of upstreams
+func (c *Client) newDialContext() selector.DialContextFunc {
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(c.conf.Other.Timeout) * time.Second,
+		KeepAlive: 30 * time.Second,
+		// DualStack: true,
+		Resolver: c.bootstrapResolver,
+	}
+	dialContext := dialer.DialContext
+	if c.conf.Other.NoIPv6 {
+		dialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			if strings.HasPrefix(network, "tcp") {
+				network = "tcp4"
+			}
+			return dialer.DialContext(ctx, network, address)
+		}
+	}
+	if c.upstreamAddrs != nil {
+		dialContext = c.upstreamAddrs.dialContext(dialContext)
+	}
+	return dialContext
+}
+
 func (c *Client) newHTTPClient() error {
 	c.httpClientMux.Lock()
 	defer c.httpClientMux.Unlock()
@@ -233,29 +344,16 @@ func (c *Client) newHTTPClient() error {
 	if c.httpTransport != nil {
 		c.httpTransport.CloseIdleConnections()
 	}
-	dialer := &net.Dialer{
-		Timeout:   time.Duration(c.conf.Other.Timeout) * time.Second,
-		KeepAlive: 30 * time.Second,
-		// DualStack: true,
-		Resolver: c.bootstrapResolver,
-	}
 	c.httpTransport = &http.Transport{
-		DialContext:           dialer.DialContext,
+		DialContext:           c.dialContext,
 		ExpectContinueTimeout: 1 * time.Second,
 		IdleConnTimeout:       90 * time.Second,
 		MaxIdleConns:          100,
 		MaxIdleConnsPerHost:   10,
 		Proxy:                 http.ProxyFromEnvironment,
+		TLSClientConfig:       c.certChecker.TLSConfig(),
 		TLSHandshakeTimeout:   time.Duration(c.conf.Other.Timeout) * time.Second,
 	}
-	if c.conf.Other.NoIPv6 {
-		c.httpTransport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
-			if strings.HasPrefix(network, "tcp") {
-				network = "tcp4"
-			}
-			return dialer.DialContext(ctx, network, address)
-		}
-	}
 	err := http2.ConfigureTransport(c.httpTransport)
 	if err != nil {
 		return err
@@ -264,13 +362,27 @@ func (c *Client) newHTTPClient() error {
 		Transport: c.httpTransport,
 		Jar:       c.cookieJar,
 	}
+	if chaos := c.conf.Chaos; chaos.LatencyProbability > 0 || chaos.ErrorProbability > 0 || chaos.ResetProbability > 0 {
+		log.Println("WARNING: injecting failures into upstream requests, as configured in [chaos]")
+		c.httpClient.Transport = &chaosTransport{
+			next:               c.httpTransport,
+			latency:            time.Duration(chaos.Latency) * time.Millisecond,
+			latencyProbability: chaos.LatencyProbability,
+			errorProbability:   chaos.ErrorProbability,
+			resetProbability:   chaos.ResetProbability,
+		}
+	}
 	c.httpClientLastCreate = time.Now()
 	return nil
 }
 
 func (c *Client) Start() error {
-	results := make(chan error, len(c.udpServers)+len(c.tcpServers))
-	for _, srv := range append(c.udpServers, c.tcpServers...) {
+	numListeners := len(c.udpServers) + len(c.tcpServers)
+	if c.conf.Other.MetricsListen != "" {
+		numListeners++
+	}
+	results := make(chan error, numListeners)
+	for _, srv := range c.udpServers {
 		go func(srv *dns.Server) {
 			err := srv.ListenAndServe()
 			if err != nil {
@@ -279,10 +391,57 @@ func (c *Client) Start() error {
 			results <- err
 		}(srv)
 	}
+	for _, srv := range c.tcpServers {
+		go func(srv *dns.Server) {
+			var err error
+			if c.conf.Other.TCPFastOpen {
+				srv.Listener, err = listenTCPFastOpen(srv.Addr)
+				if err == nil {
+					err = srv.ActivateAndServe()
+				}
+			} else {
+				err = srv.ListenAndServe()
+			}
+			if err != nil {
+				log.Println(err)
+			}
+			results <- err
+		}(srv)
+	}
+	if c.conf.Other.MetricsListen != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics.Handler())
+			mux.HandleFunc("/report", c.serveReport)
+			mux.HandleFunc("/ready", c.readyHandler)
+			err := http.ListenAndServe(c.conf.Other.MetricsListen, mux)
+			if err != nil {
+				log.Println(err)
+			}
+			results <- err
+		}()
+	}
+
+	if c.upstreamAddrs != nil {
+		var upstreamURLs []string
+		for _, u := range c.conf.Upstream.UpstreamGoogle {
+			upstreamURLs = append(upstreamURLs, u.URL)
+		}
+		for _, u := range c.conf.Upstream.UpstreamIETF {
+			upstreamURLs = append(upstreamURLs, u.URL)
+		}
+		c.upstreamAddrs.start(upstreamURLs)
+	}
 
 	// start evaluation loop
 	c.selector.StartEvaluate()
 
+	go c.watchClockJumps()
+
+	if c.conf.Other.ReportInterval != 0 {
+		go c.logReports(time.Duration(c.conf.Other.ReportInterval) * time.Hour)
+	}
+
 	for i := 0; i < cap(results); i++ {
 		err := <-results
 		if err != nil {
@@ -294,6 +453,19 @@ func (c *Client) Start() error {
 	return nil
 }
 
+func (c *Client) serverStarted() {
+	atomic.AddInt32(&c.startedServers, 1)
+}
+
+// readyHandler answers 200 once all DNS listeners are open, for readiness probes
+func (c *Client) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if int(atomic.LoadInt32(&c.startedServers)) < len(c.udpServers)+len(c.tcpServers) {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ready\n")
+}
+
 func (c *Client) handlerFunc(w dns.ResponseWriter, r *dns.Msg, isTCP bool) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.conf.Other.Timeout)*time.Second)
 	defer cancel()
@@ -303,6 +475,8 @@ func (c *Client) handlerFunc(w dns.ResponseWriter, r *dns.Msg, isTCP bool) {
 		return
 	}
 
+	w = &compressWriter{ResponseWriter: w, compress: c.compression.compress(w.RemoteAddr())}
+
 	if len(r.Question) != 1 {
 		log.Println("Number of questions is not 1")
 		reply := jsonDNS.PrepareReply(r)
@@ -311,6 +485,10 @@ func (c *Client) handlerFunc(w dns.ResponseWriter, r *dns.Msg, isTCP bool) {
 		return
 	}
 	question := &r.Question[0]
+	c.stats.OnQuery(question.Qtype)
+	if c.conf.Other.PrefetchSVCBTargets && (question.Qtype == typeSVCB || question.Qtype == typeHTTPS) {
+		w = &svcbPrefetchWriter{ResponseWriter: w, c: c}
+	}
 	questionName := question.Name
 	questionClass := ""
 	if qclass, ok := dns.ClassToString[question.Qclass]; ok {
@@ -329,11 +507,7 @@ func (c *Client) handlerFunc(w dns.ResponseWriter, r *dns.Msg, isTCP bool) {
 	}
 
 	shouldPassthrough := false
-	passthroughQuestionName := questionName
-	if punycode, err := idna.ToASCII(passthroughQuestionName); err != nil {
-		passthroughQuestionName = punycode
-	}
-	passthroughQuestionName = "." + strings.ToLower(strings.Trim(passthroughQuestionName, ".")) + "."
+	passthroughQuestionName := "." + strings.Trim(dnsutil.CanonicalName(questionName), ".") + "."
 	for _, passthrough := range c.passthrough {
 		if strings.HasSuffix(passthroughQuestionName, passthrough) {
 			shouldPassthrough = true
@@ -362,13 +536,59 @@ func (c *Client) handlerFunc(w dns.ResponseWriter, r *dns.Msg, isTCP bool) {
 		return
 	}
 
-	upstream := c.selector.Get()
+	if c.conf.Other.MinimalANY && dnsutil.IsMinimalANYQuery(r) {
+		// RFC 8482: ANY is mostly used for amplification, answer locally
+		reply := jsonDNS.PrepareReply(r)
+		reply.Rcode = dns.RcodeSuccess
+		reply.Answer = []dns.RR{dnsutil.MinimalANYAnswer(question.Name)}
+		w.WriteMsg(reply)
+		return
+	}
+
+	// wait before taking an admission slot or an upstream slot, so that a
+	// paced query doesn't hold capacity it isn't using
+	if c.pacer != nil {
+		if err := c.pacer.Wait(ctx); err != nil {
+			log.Printf("Request \"%s %s %s\" timed out waiting for upstream pacing.\n", questionName, questionClass, questionType)
+			reply := jsonDNS.PrepareReply(r)
+			reply.Rcode = dns.RcodeServerFailure
+			w.WriteMsg(reply)
+			return
+		}
+	}
+
+	if !c.admission.admit(question.Qtype) {
+		c.stats.OnBlock(question.Qtype, "shed")
+		if c.conf.Other.Verbose {
+			log.Printf("Request \"%s %s %s\" is refused due to overload.\n", questionName, questionClass, questionType)
+		}
+		reply := jsonDNS.PrepareReply(r)
+		reply.Rcode = dns.RcodeRefused
+		w.WriteMsg(reply)
+		return
+	}
+	defer c.admission.release()
+
+	if c.mirror != nil {
+		c.mirror.sample(r)
+	}
+
+	upstream := c.acquireUpstream()
+	if upstream == nil {
+		log.Printf("Request \"%s %s %s\" failed, all upstreams have too many requests in flight.\n", questionName, questionClass, questionType)
+		reply := jsonDNS.PrepareReply(r)
+		reply.Rcode = dns.RcodeServerFailure
+		w.WriteMsg(reply)
+		return
+	}
+	defer upstream.Release()
 	requestType := upstream.RequestType
 
 	if c.conf.Other.Verbose {
 		log.Println("choose upstream:", upstream)
 	}
 
+	requestStart := time.Now()
 	var req *DNSRequest
 	switch requestType {
 	case "application/dns-json":
@@ -382,6 +602,7 @@ func (c *Client) handlerFunc(w dns.ResponseWriter, r *dns.Msg, isTCP bool) {
 	}
 
 	if req.err != nil {
+		c.stats.OnUpstreamResult(upstream.URL, false, 0)
 		if urlErr, ok := req.err.(*url.Error); ok {
 			// should we only check timeout?
 			if urlErr.Timeout() {
@@ -395,6 +616,8 @@ func (c *Client) handlerFunc(w dns.ResponseWriter, r *dns.Msg, isTCP bool) {
 	// if req.err == nil, req.response != nil
 	defer req.response.Body.Close()
 
+	c.stats.OnUpstreamResult(upstream.URL, req.response.StatusCode/100 == 2, time.Since(requestStart))
+
 	for _, header := range c.conf.Other.DebugHTTPHeaders {
 		if value := req.response.Header.Get(header); value != "" {
 			log.Printf("%s: %s\n", header, value)
@@ -439,19 +662,119 @@ func (c *Client) handlerFunc(w dns.ResponseWriter, r *dns.Msg, isTCP bool) {
 	}
 }
 
+// rotateAnswers rotates the address records of reply by one more position
+// than the previous response, if rotate_answers is enabled
+func (c *Client) rotateAnswers(reply *dns.Msg) {
+	if !c.conf.Other.RotateAnswers {
+		return
+	}
+	dnsutil.RotateAddresses(reply, atomic.AddUint32(&c.answerRotation, 1))
+}
+
+// applyADPolicy decides whether the AD bit of upstream is passed on to the
+// client
+func (c *Client) applyADPolicy(reply *dns.Msg) {
+	if c.conf.Other.ADPolicy == "clear" {
+		reply.AuthenticatedData = false
+	}
+}
+
+var spilledQueries = metrics.NewCounter(
+	"doh_client_upstream_spilled_queries_total",
+	"Number of queries moved to another upstream because the chosen one had too many requests in flight.",
+	"upstream",
+)
+
+// acquireUpstream asks the selector for an upstream that has less than
+// max_inflight_per_upstream requests in flight. A full upstream is skipped in
+// favor of the next-best one, so that a slow upstream doesn't pile up hung
+// HTTP/2 streams. It returns nil if all upstreams are full.
+func (c *Client) acquireUpstream() *selector.Upstream {
+	maxInflight := int32(c.conf.Upstream.MaxInflightPerUpstream)
+	upstream := c.selector.Get()
+	var tried map[*selector.Upstream]bool
+	for upstream != nil {
+		if upstream.TryAcquire(maxInflight) {
+			return upstream
+		}
+		spilledQueries.Inc(upstream.URL)
+		if tried == nil {
+			tried = make(map[*selector.Upstream]bool)
+		}
+		tried[upstream] = true
+		upstream = c.selector.GetExcluding(tried)
+	}
+	return nil
+}
+
+var rrlLimitedResponses = metrics.NewCounter(
+	"doh_client_rrl_limited_responses_total",
+	"Number of UDP responses withheld by response rate limiting.",
+	"action",
+)
+
 func (c *Client) udpHandlerFunc(w dns.ResponseWriter, r *dns.Msg) {
+	if c.rrl != nil {
+		if remoteAddr, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			switch c.rrl.Check(remoteAddr.IP) {
+			case rrl.Drop:
+				rrlLimitedResponses.Inc("drop")
+				c.stats.OnBlock(queryType(r), "rrl_drop")
+				return
+
+			case rrl.Slip:
+				rrlLimitedResponses.Inc("slip")
+				c.stats.OnBlock(queryType(r), "rrl_slip")
+				reply := jsonDNS.PrepareReply(r)
+				reply.Rcode = dns.RcodeSuccess
+				reply.Truncated = true
+				w.WriteMsg(reply)
+				return
+			}
+		}
+	}
 	c.handlerFunc(w, r, false)
 }
 
+// queryType returns the type of the first question, or 0 if there is none
+func queryType(r *dns.Msg) uint16 {
+	if len(r.Question) == 0 {
+		return 0
+	}
+	return r.Question[0].Qtype
+}
+
 func (c *Client) tcpHandlerFunc(w dns.ResponseWriter, r *dns.Msg) {
+	if dnsutil.HasTCPKeepalive(r) {
+		w = &keepaliveWriter{ResponseWriter: w, c: c}
+	}
 	c.handlerFunc(w, r, true)
 }
 
+// tcpIdleTimeout is how long an idle TCP connection from a client is kept open
+func (c *Client) tcpIdleTimeout() time.Duration {
+	return time.Duration(c.conf.Other.TCPIdleTimeout) * time.Second
+}
+
 var (
 	ipv4Mask24 = net.IPMask{255, 255, 255, 0}
 	ipv6Mask56 = net.CIDRMask(56, 128)
 )
 
+// maskClientAddress clears the bits of a client subnet address beyond its
+// source netmask, so that the same subnet always gives the same request
+func maskClientAddress(address net.IP, netmask uint8) net.IP {
+	bits := 128
+	if ipv4 := address.To4(); ipv4 != nil {
+		address, bits = ipv4, 32
+	}
+	// an invalid netmask gives no mask, leave the address to the upstream
+	if masked := address.Mask(net.CIDRMask(int(netmask), bits)); masked != nil {
+		return masked
+	}
+	return address
+}
+
 func (c *Client) findClientIP(w dns.ResponseWriter, r *dns.Msg) (ednsClientAddress net.IP, ednsClientNetmask uint8) {
 	ednsClientNetmask = 255
 	if c.conf.Other.NoECS {
@@ -461,7 +784,7 @@ func (c *Client) findClientIP(w dns.ResponseWriter, r *dns.Msg) (ednsClientAddre
 		for _, option := range opt.Option {
 			if option.Option() == dns.EDNS0SUBNET {
 				edns0Subnet := option.(*dns.EDNS0_SUBNET)
-				ednsClientAddress = edns0Subnet.Address
+				ednsClientAddress = maskClientAddress(edns0Subnet.Address, edns0Subnet.SourceNetmask)
 				ednsClientNetmask = edns0Subnet.SourceNetmask
 				return
 			}
@@ -0,0 +1,60 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	clockCheckInterval = 5 * time.Second
+	clockJumpThreshold = 30 * time.Second
+)
+
+// watchClockJumps compares the wall clock against the monotonic clock, which
+// stops during system suspend and is not stepped by NTP. A difference means
+// the system has just resumed from sleep or the wall clock has been changed,
+// so connections made before are likely dead and are closed proactively,
+// instead of letting the first queries after resume time out on them.
+func (c *Client) watchClockJumps() {
+	ticker := time.NewTicker(clockCheckInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	for range ticker.C {
+		now := time.Now()
+		monotonicElapsed := now.Sub(last)
+		wallElapsed := now.Round(0).Sub(last.Round(0))
+		last = now
+
+		jump := wallElapsed - monotonicElapsed
+		if jump < clockJumpThreshold && jump > -clockJumpThreshold {
+			continue
+		}
+		log.Printf("Wall clock jumped by %s, probably resumed from sleep. Resetting upstream connections.\n", jump.Truncate(time.Second))
+		c.httpClientMux.RLock()
+		c.httpTransport.CloseIdleConnections()
+		c.httpClientMux.RUnlock()
+	}
+}
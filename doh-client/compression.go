@@ -0,0 +1,95 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"net"
+	"sort"
+
+	"github.com/m13253/dns-over-https/doh-client/config"
+	"github.com/miekg/dns"
+)
+
+type compressionSubnet struct {
+	subnet   *net.IPNet
+	compress bool
+}
+
+// compressionPolicy decides whether names in responses to a client are
+// compressed. Some broken embedded stub resolvers mis-parse compressed names,
+// so it can be disabled globally with no_compression, or per client subnet.
+type compressionPolicy struct {
+	subnets         []compressionSubnet // longest prefix first
+	defaultCompress bool
+}
+
+func newCompressionPolicy(conf *config.Config) *compressionPolicy {
+	cp := &compressionPolicy{
+		defaultCompress: !conf.Other.NoCompression,
+	}
+	for _, rule := range conf.Compression {
+		// validated by config.LoadConfig
+		_, subnet, _ := net.ParseCIDR(rule.Subnet)
+		cp.subnets = append(cp.subnets, compressionSubnet{subnet: subnet, compress: rule.Compress})
+	}
+	sort.SliceStable(cp.subnets, func(i, j int) bool {
+		iOnes, _ := cp.subnets[i].subnet.Mask.Size()
+		jOnes, _ := cp.subnets[j].subnet.Mask.Size()
+		return iOnes > jOnes
+	})
+	return cp
+}
+
+// compress reports whether responses to the client at addr are compressed,
+// the most specific matching subnet wins
+func (cp *compressionPolicy) compress(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	}
+	if ip != nil {
+		for _, s := range cp.subnets {
+			if s.subnet.Contains(ip) {
+				return s.compress
+			}
+		}
+	}
+	return cp.defaultCompress
+}
+
+// compressWriter applies the compression policy to every message written
+// with WriteMsg. Responses written as raw bytes are packed by the caller with
+// the policy already applied.
+type compressWriter struct {
+	dns.ResponseWriter
+	compress bool
+}
+
+func (w *compressWriter) WriteMsg(m *dns.Msg) error {
+	m.Compress = w.compress
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,162 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package config
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+
+	"github.com/BurntSushi/toml"
+)
+
+// A bundle is a single file holding a configuration and its signature, both
+// as PEM blocks:
+//
+//	-----BEGIN DOH-CLIENT CONFIG-----
+//	(base64 of the TOML configuration)
+//	-----END DOH-CLIENT CONFIG-----
+//	-----BEGIN DOH-CLIENT SIGNATURE-----
+//	(base64 of the signature)
+//	-----END DOH-CLIENT SIGNATURE-----
+//
+// The configuration may be split into several CONFIG blocks, e.g. the main
+// configuration and a long list of routing rules. They are concatenated in
+// order and decoded as one document, and the signature covers all of them, so
+// nothing in the bundle is loaded unsigned.
+//
+// The signature is made over the SHA-256 of the configuration, with PKCS #1
+// v1.5 for RSA keys or ASN.1 encoded for ECDSA keys, which is what
+// `openssl dgst -sha256 -sign` produces.
+const (
+	bundleConfigType    = "DOH-CLIENT CONFIG"
+	bundleSignatureType = "DOH-CLIENT SIGNATURE"
+)
+
+var errBundleSignature = &configError{"bundle signature verification failed"}
+
+// LoadBundle loads the configuration from a signed bundle, the signature is
+// verified against the PEM encoded public key in publicKeyPath. Unsigned or
+// tampered bundles are refused.
+func LoadBundle(path, publicKeyPath string) (*Config, error) {
+	publicKey, err := loadPublicKey(publicKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		// the files of a directory would be loaded unsigned
+		return nil, &configError{fmt.Sprintf("%s is a directory, a bundle must be a single file", path)}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	content, err := VerifyBundle(data, publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	conf := &Config{}
+	metaData, err := toml.Decode(string(content), conf)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range metaData.Undecoded() {
+		return nil, &configError{fmt.Sprintf("unknown option %q in %s", key.String(), path)}
+	}
+	return checkConfig(conf)
+}
+
+// VerifyBundle checks the signature of a bundle and returns the configuration
+// in it, with all of its parts concatenated
+func VerifyBundle(data []byte, publicKey crypto.PublicKey) ([]byte, error) {
+	var content, signature []byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case bundleConfigType:
+			if signature != nil {
+				return nil, &configError{"bundle has configuration after the signature"}
+			}
+			content = append(content, block.Bytes...)
+		case bundleSignatureType:
+			if signature != nil {
+				return nil, &configError{"bundle has more than one signature"}
+			}
+			signature = block.Bytes
+		default:
+			return nil, &configError{fmt.Sprintf("unexpected block %q in bundle", block.Type)}
+		}
+	}
+	if content == nil {
+		return nil, &configError{"bundle has no configuration"}
+	}
+	if signature == nil {
+		return nil, &configError{"bundle is not signed"}
+	}
+
+	digest := sha256.Sum256(content)
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errBundleSignature
+		}
+	case *ecdsa.PublicKey:
+		var sig struct {
+			R, S *big.Int
+		}
+		rest, err := asn1.Unmarshal(signature, &sig)
+		if err != nil || len(rest) != 0 || !ecdsa.Verify(key, digest[:], sig.R, sig.S) {
+			return nil, errBundleSignature
+		}
+	default:
+		return nil, errors.New("unsupported public key type, only RSA and ECDSA are supported")
+	}
+	return content, nil
+}
+
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, &configError{fmt.Sprintf("%s: no PEM encoded public key found", path)}
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
@@ -0,0 +1,174 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package config
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"testing"
+)
+
+const (
+	testConfig = "upstream_selector = \"random\"\n"
+	testRules  = "[[upstream.upstream_ietf]]\n    url = \"https://dns.example/dns-query\"\n"
+)
+
+func pemBlock(blockType string, data []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data})
+}
+
+func signRSA(t *testing.T, key *rsa.PrivateKey, content []byte) []byte {
+	digest := sha256.Sum256(content)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+func signECDSA(t *testing.T, key *ecdsa.PrivateKey, content []byte) []byte {
+	digest := sha256.Sum256(content)
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := asn1.Marshal(struct {
+		R, S *big.Int
+	}{r, s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+func TestVerifyBundle(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte(testConfig + testRules)
+	rsaSignature := signRSA(t, rsaKey, content)
+	ecdsaSignature := signECDSA(t, ecdsaKey, content)
+
+	tests := []struct {
+		name      string
+		publicKey crypto.PublicKey
+		bundle    [][]byte
+		wantErr   bool
+	}{
+		{
+			name:      "valid RSA",
+			publicKey: &rsaKey.PublicKey,
+			bundle: [][]byte{
+				pemBlock(bundleConfigType, []byte(testConfig)),
+				pemBlock(bundleConfigType, []byte(testRules)),
+				pemBlock(bundleSignatureType, rsaSignature),
+			},
+		},
+		{
+			name:      "valid ECDSA",
+			publicKey: &ecdsaKey.PublicKey,
+			bundle: [][]byte{
+				pemBlock(bundleConfigType, content),
+				pemBlock(bundleSignatureType, ecdsaSignature),
+			},
+		},
+		{
+			name:      "wrong key",
+			publicKey: &rsaKey.PublicKey,
+			bundle: [][]byte{
+				pemBlock(bundleConfigType, content),
+				pemBlock(bundleSignatureType, ecdsaSignature),
+			},
+			wantErr: true,
+		},
+		{
+			name:      "tampered config block",
+			publicKey: &rsaKey.PublicKey,
+			bundle: [][]byte{
+				pemBlock(bundleConfigType, []byte(testConfig)),
+				pemBlock(bundleConfigType, bytes.Replace([]byte(testRules), []byte("dns.example"), []byte("evil.example"), 1)),
+				pemBlock(bundleSignatureType, rsaSignature),
+			},
+			wantErr: true,
+		},
+		{
+			name:      "config after the signature",
+			publicKey: &rsaKey.PublicKey,
+			bundle: [][]byte{
+				pemBlock(bundleConfigType, content),
+				pemBlock(bundleSignatureType, rsaSignature),
+				pemBlock(bundleConfigType, []byte(testRules)),
+			},
+			wantErr: true,
+		},
+		{
+			name:      "missing signature",
+			publicKey: &rsaKey.PublicKey,
+			bundle: [][]byte{
+				pemBlock(bundleConfigType, content),
+			},
+			wantErr: true,
+		},
+		{
+			name:      "unknown block",
+			publicKey: &rsaKey.PublicKey,
+			bundle: [][]byte{
+				pemBlock(bundleConfigType, content),
+				pemBlock("CERTIFICATE", []byte("not a certificate")),
+				pemBlock(bundleSignatureType, rsaSignature),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := VerifyBundle(bytes.Join(tt.bundle, nil), tt.publicKey)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("VerifyBundle() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("VerifyBundle() = %v", err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("VerifyBundle() = %q, want %q", got, content)
+			}
+		})
+	}
+}
@@ -25,8 +25,10 @@ package config
 
 import (
 	"fmt"
+	"net"
 
 	"github.com/BurntSushi/toml"
+	"github.com/m13253/dns-over-https/internal/confwatch"
 )
 
 const (
@@ -36,43 +38,114 @@ const (
 )
 
 type upstreamDetail struct {
-	URL    string `toml:"url"`
-	Weight int32  `toml:"weight"`
+	URL           string `toml:"url"`
+	Weight        int32  `toml:"weight"`
+	Probe         string `toml:"probe"`
+	ProbeInterval uint   `toml:"probe_interval"`
 }
 
 type upstream struct {
-	UpstreamGoogle   []upstreamDetail `toml:"upstream_google"`
-	UpstreamIETF     []upstreamDetail `toml:"upstream_ietf"`
-	UpstreamSelector string           `toml:"upstream_selector"` // usable: random or weighted_random
+	UpstreamGoogle         []upstreamDetail `toml:"upstream_google"`
+	UpstreamIETF           []upstreamDetail `toml:"upstream_ietf"`
+	UpstreamSelector       string           `toml:"upstream_selector"` // usable: random or weighted_random
+	PrewarmConnections     bool             `toml:"prewarm_connections"`
+	DecisionLogSampleRate  float64          `toml:"decision_log_sample_rate"`
+	MaxInflightPerUpstream uint             `toml:"max_inflight_per_upstream"`
+	PacingRate             float64          `toml:"pacing_rate"`
+	PacingBurst            uint             `toml:"pacing_burst"`
+	PrefetchAddresses      bool             `toml:"prefetch_addresses"`
+	PenaltyHalfLife        uint             `toml:"penalty_half_life"`
 }
 
 type others struct {
-	Bootstrap        []string `toml:"bootstrap"`
-	Passthrough      []string `toml:"passthrough"`
-	Timeout          uint     `toml:"timeout"`
-	NoCookies        bool     `toml:"no_cookies"`
-	NoECS            bool     `toml:"no_ecs"`
-	NoIPv6           bool     `toml:"no_ipv6"`
-	Verbose          bool     `toml:"verbose"`
-	DebugHTTPHeaders []string `toml:"debug_http_headers"`
+	Bootstrap             []string `toml:"bootstrap"`
+	Passthrough           []string `toml:"passthrough"`
+	Timeout               uint     `toml:"timeout"`
+	NoCookies             bool     `toml:"no_cookies"`
+	NoECS                 bool     `toml:"no_ecs"`
+	NoIPv6                bool     `toml:"no_ipv6"`
+	NoCompression         bool     `toml:"no_compression"`
+	Verbose               bool     `toml:"verbose"`
+	DebugHTTPHeaders      []string `toml:"debug_http_headers"`
+	MetricsListen         string   `toml:"metrics_listen"`
+	CertExpiryWarningDays uint     `toml:"cert_expiry_warning_days"`
+	MaxQuerySize          uint     `toml:"max_query_size"`
+	TCPFastOpen           bool     `toml:"tcp_fast_open"`
+	TCPIdleTimeout        uint     `toml:"tcp_idle_timeout"`
+	MinimalANY            bool     `toml:"minimal_any"`
+	RotateAnswers         bool     `toml:"rotate_answers"`
+	PrefetchSVCBTargets   bool     `toml:"prefetch_svcb_targets"`
+	ADPolicy              string   `toml:"ad_policy"`
+	ConfigReloadInterval  uint     `toml:"config_reload_interval"`
+	ReportInterval        uint     `toml:"report_interval"`
+}
+
+type rateLimit struct {
+	ResponsesPerSecond uint `toml:"responses_per_second"`
+	Window             uint `toml:"window"`
+	Slip               uint `toml:"slip"`
+	Leak               uint `toml:"leak"`
+	IPv4PrefixLength   int  `toml:"ipv4_prefix_length"`
+	IPv6PrefixLength   int  `toml:"ipv6_prefix_length"`
+}
+
+type loadShedding struct {
+	ShedInflight     uint     `toml:"shed_inflight"`
+	MaxInflight      uint     `toml:"max_inflight"`
+	LowPriorityTypes []string `toml:"low_priority_types"`
+}
+
+type mirror struct {
+	URL     string  `toml:"url"`
+	Address string  `toml:"address"`
+	Percent float64 `toml:"percent"`
+}
+
+type compressionRule struct {
+	Subnet   string `toml:"subnet"`
+	Compress bool   `toml:"compress"`
+}
+
+// chaos injects failures into upstream requests for testing, it is
+// intentionally left out of the example configuration
+type chaos struct {
+	Latency            uint    `toml:"latency"` // in milliseconds
+	LatencyProbability float64 `toml:"latency_probability"`
+	ErrorProbability   float64 `toml:"error_probability"`
+	ResetProbability   float64 `toml:"reset_probability"`
 }
 
 type Config struct {
-	Listen   []string `toml:"listen"`
-	Upstream upstream `toml:"upstream"`
-	Other    others   `toml:"others"`
+	Listen       []string          `toml:"listen"`
+	Upstream     upstream          `toml:"upstream"`
+	Other        others            `toml:"others"`
+	RateLimit    rateLimit         `toml:"rate_limit"`
+	LoadShedding loadShedding      `toml:"load_shedding"`
+	Mirror       mirror            `toml:"mirror"`
+	Compression  []compressionRule `toml:"compression"`
+	Chaos        chaos             `toml:"chaos"`
 }
 
 func LoadConfig(path string) (*Config, error) {
 	conf := &Config{}
-	metaData, err := toml.DecodeFile(path, conf)
+	files, err := confwatch.Files(path)
 	if err != nil {
 		return nil, err
 	}
-	for _, key := range metaData.Undecoded() {
-		return nil, &configError{fmt.Sprintf("unknown option %q", key.String())}
+	for _, file := range files {
+		metaData, err := toml.DecodeFile(file, conf)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range metaData.Undecoded() {
+			return nil, &configError{fmt.Sprintf("unknown option %q in %s", key.String(), file)}
+		}
 	}
+	return checkConfig(conf)
+}
 
+// checkConfig fills in the defaults of a decoded configuration and validates it
+func checkConfig(conf *Config) (*Config, error) {
 	if len(conf.Listen) == 0 {
 		conf.Listen = []string{"127.0.0.1:53", "[::1]:53"}
 	}
@@ -82,10 +155,74 @@ func LoadConfig(path string) (*Config, error) {
 	if conf.Other.Timeout == 0 {
 		conf.Other.Timeout = 10
 	}
+	if conf.Other.MaxQuerySize == 0 {
+		conf.Other.MaxQuerySize = 4096
+	}
+	switch conf.Other.ADPolicy {
+	case "":
+		conf.Other.ADPolicy = "passthrough"
+	case "passthrough", "clear":
+	case "validated":
+		return nil, &configError{`ad_policy "validated" is not supported yet, doh-client has no local DNSSEC validation`}
+	default:
+		return nil, &configError{fmt.Sprintf("unknown ad_policy %q", conf.Other.ADPolicy)}
+	}
+	if conf.Other.TCPIdleTimeout == 0 {
+		conf.Other.TCPIdleTimeout = 8
+	}
+	if conf.Other.CertExpiryWarningDays == 0 {
+		conf.Other.CertExpiryWarningDays = 14
+	}
+
+	if conf.RateLimit.Window == 0 {
+		conf.RateLimit.Window = 15
+	}
+	if conf.RateLimit.IPv4PrefixLength == 0 {
+		conf.RateLimit.IPv4PrefixLength = 24
+	}
+	if conf.RateLimit.IPv6PrefixLength == 0 {
+		conf.RateLimit.IPv6PrefixLength = 56
+	}
+	if conf.RateLimit.IPv4PrefixLength < 0 || conf.RateLimit.IPv4PrefixLength > 32 || conf.RateLimit.IPv6PrefixLength < 0 || conf.RateLimit.IPv6PrefixLength > 128 {
+		return nil, &configError{"invalid rate_limit prefix length"}
+	}
+
+	if conf.LoadShedding.LowPriorityTypes == nil {
+		conf.LoadShedding.LowPriorityTypes = []string{"ANY", "TXT"}
+	}
+
+	if conf.Upstream.PacingRate < 0 {
+		return nil, &configError{"pacing_rate must not be negative"}
+	}
+	if conf.Upstream.PacingBurst == 0 {
+		conf.Upstream.PacingBurst = 20
+	}
+
+	if conf.Mirror.Percent < 0 || conf.Mirror.Percent > 100 {
+		return nil, &configError{"mirror percent must be between 0 and 100"}
+	}
+	if conf.Mirror.Percent > 0 && (conf.Mirror.URL == "") == (conf.Mirror.Address == "") {
+		return nil, &configError{"mirror needs exactly one of url and address"}
+	}
+
+	for _, probability := range []float64{conf.Chaos.LatencyProbability, conf.Chaos.ErrorProbability, conf.Chaos.ResetProbability} {
+		if probability < 0 || probability > 1 {
+			return nil, &configError{"chaos probabilities must be between 0 and 1"}
+		}
+	}
 
 	if conf.Upstream.UpstreamSelector == "" {
 		conf.Upstream.UpstreamSelector = Random
 	}
+	if conf.Upstream.DecisionLogSampleRate < 0 || conf.Upstream.DecisionLogSampleRate > 1 {
+		return nil, &configError{"decision_log_sample_rate must be between 0 and 1"}
+	}
+
+	for _, rule := range conf.Compression {
+		if _, _, err := net.ParseCIDR(rule.Subnet); err != nil {
+			return nil, &configError{fmt.Sprintf("compression: invalid subnet %q", rule.Subnet)}
+		}
+	}
 
 	return conf, nil
 }
@@ -33,15 +33,17 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/m13253/dns-over-https/doh-client/selector"
+	"github.com/m13253/dns-over-https/internal/dnsutil"
 	"github.com/m13253/dns-over-https/json-dns"
 	"github.com/miekg/dns"
 )
 
 func (c *Client) generateRequestGoogle(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, isTCP bool, upstream *selector.Upstream) *DNSRequest {
 	question := &r.Question[0]
-	questionName := question.Name
+	questionName := dnsutil.CanonicalName(question.Name)
 	questionClass := question.Qclass
 	if questionClass != dns.ClassINET {
 		reply := jsonDNS.PrepareReply(r)
@@ -63,6 +65,10 @@ func (c *Client) generateRequestGoogle(ctx context.Context, w dns.ResponseWriter
 	if r.CheckingDisabled {
 		requestURL += "&cd=1"
 	}
+	if opt := r.IsEdns0(); opt != nil && opt.Do() {
+		// keep validating and non-validating clients apart in HTTP caches
+		requestURL += "&do=1"
+	}
 
 	udpSize := uint16(512)
 	if opt := r.IsEdns0(); opt != nil {
@@ -154,7 +160,22 @@ func (c *Client) parseResponseGoogle(ctx context.Context, w dns.ResponseWriter,
 		log.Printf("DNS error: %s\n", respJSON.Comment)
 	}
 
-	fullReply := jsonDNS.Unmarshal(req.reply, &respJSON, req.udpSize, req.ednsClientNetmask)
+	// Use the clock of the upstream to interpret absolute expire times
+	now := time.Now().UTC()
+	if headerNow := req.response.Header.Get("Date"); headerNow != "" {
+		if nowDate, err := time.Parse(http.TimeFormat, headerNow); err == nil {
+			now = nowDate
+		} else {
+			log.Println(err)
+		}
+	}
+
+	fullReply := jsonDNS.UnmarshalAt(req.reply, &respJSON, req.udpSize, req.ednsClientNetmask, now)
+	restoreOwnerNames(fullReply, dnsutil.CanonicalName(r.Question[0].Name), r.Question[0].Name)
+	c.rotateAnswers(fullReply)
+	c.applyADPolicy(fullReply)
+
+	fullReply.Compress = c.compression.compress(w.RemoteAddr())
 	buf, err := fullReply.Pack()
 	if err != nil {
 		log.Println(err)
@@ -173,3 +194,19 @@ func (c *Client) parseResponseGoogle(ctx context.Context, w dns.ResponseWriter,
 	}
 	w.Write(buf)
 }
+
+// restoreOwnerNames gives the records owned by the name sent upstream, which
+// is in A-labels, the name the client asked for, so that stubs which compare
+// the owner names with their question accept the answer
+func restoreOwnerNames(reply *dns.Msg, sentName, questionName string) {
+	if strings.EqualFold(sentName, questionName) {
+		return
+	}
+	for _, section := range [][]dns.RR{reply.Answer, reply.Ns, reply.Extra} {
+		for _, rr := range section {
+			if strings.EqualFold(rr.Header().Name, sentName) {
+				rr.Header().Name = questionName
+			}
+		}
+	}
+}
@@ -26,7 +26,6 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -36,58 +35,32 @@ import (
 	"time"
 
 	"github.com/m13253/dns-over-https/doh-client/selector"
+	"github.com/m13253/dns-over-https/internal/dnsutil"
 	"github.com/m13253/dns-over-https/json-dns"
 	"github.com/miekg/dns"
 )
 
 func (c *Client) generateRequestIETF(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, isTCP bool, upstream *selector.Upstream) *DNSRequest {
-	opt := r.IsEdns0()
 	udpSize := uint16(512)
-	if opt == nil {
-		opt = new(dns.OPT)
-		opt.Hdr.Name = "."
-		opt.Hdr.Rrtype = dns.TypeOPT
-		opt.SetUDPSize(dns.DefaultMsgSize)
-		opt.SetDo(false)
-		r.Extra = append([]dns.RR{opt}, r.Extra...)
-	} else {
+	if opt := r.IsEdns0(); opt != nil {
 		udpSize = opt.UDPSize()
 	}
-	var edns0Subnet *dns.EDNS0_SUBNET
-	for _, option := range opt.Option {
-		if option.Option() == dns.EDNS0SUBNET {
-			edns0Subnet = option.(*dns.EDNS0_SUBNET)
-			break
-		}
-	}
+	opt := dnsutil.EnsureOPT(r)
+	edns0Subnet := dnsutil.FindClientSubnet(opt)
 	ednsClientAddress, ednsClientNetmask := net.IP(nil), uint8(255)
 	if edns0Subnet == nil {
-		ednsClientFamily := uint16(0)
 		ednsClientAddress, ednsClientNetmask = c.findClientIP(w, r)
 		if ednsClientAddress != nil {
-			if ipv4 := ednsClientAddress.To4(); ipv4 != nil {
-				ednsClientFamily = 1
-				ednsClientAddress = ipv4
-				ednsClientNetmask = 24
-			} else {
-				ednsClientFamily = 2
-				ednsClientNetmask = 56
-			}
-			edns0Subnet = new(dns.EDNS0_SUBNET)
-			edns0Subnet.Code = dns.EDNS0SUBNET
-			edns0Subnet.Family = ednsClientFamily
-			edns0Subnet.SourceNetmask = ednsClientNetmask
-			edns0Subnet.SourceScope = 0
-			edns0Subnet.Address = ednsClientAddress
+			ednsClientNetmask = dnsutil.DefaultClientNetmask(ednsClientAddress)
+			edns0Subnet = dnsutil.NewClientSubnet(ednsClientAddress, ednsClientNetmask, 0)
+			ednsClientAddress = edns0Subnet.Address
 			opt.Option = append(opt.Option, edns0Subnet)
 		}
 	} else {
 		ednsClientAddress, ednsClientNetmask = edns0Subnet.Address, edns0Subnet.SourceNetmask
 	}
 
-	requestID := r.Id
-	r.Id = 0
-	requestBinary, err := r.Pack()
+	requestBinary, err := canonicalRequest(r, edns0Subnet)
 	if err != nil {
 		log.Println(err)
 		reply := jsonDNS.PrepareReply(r)
@@ -97,8 +70,7 @@ func (c *Client) generateRequestIETF(ctx context.Context, w dns.ResponseWriter,
 			err: err,
 		}
 	}
-	r.Id = requestID
-	requestBase64 := base64.RawURLEncoding.EncodeToString(requestBinary)
+	requestBase64 := dnsutil.EncodeBase64URL(requestBinary)
 
 	requestURL := fmt.Sprintf("%s?ct=application/dns-message&dns=%s", upstream.URL, requestBase64)
 
@@ -163,6 +135,29 @@ func (c *Client) generateRequestIETF(ctx context.Context, w dns.ResponseWriter,
 	}
 }
 
+// canonicalRequest packs r for the upstream so that HTTP caches see the same
+// request for queries which only differ in ways that don't change the answer:
+// the ID is zeroed and the name is lower-cased, e.g. against DNS 0x20 case
+// randomization, and the EDNS0-Client-Subnet address is cut to its source
+// netmask with the scope zeroed, as RFC 7871 requires for queries. Both the ID
+// and the name are restored in the reply. The DO and CD bits are kept as
+// they are, they change the answer. r itself is not modified.
+func canonicalRequest(r *dns.Msg, edns0Subnet *dns.EDNS0_SUBNET) ([]byte, error) {
+	requestID, questionName := r.Id, r.Question[0].Name
+	r.Id, r.Question[0].Name = 0, strings.ToLower(questionName)
+	defer func() {
+		r.Id, r.Question[0].Name = requestID, questionName
+	}()
+	if edns0Subnet != nil {
+		address, scope := edns0Subnet.Address, edns0Subnet.SourceScope
+		edns0Subnet.Address, edns0Subnet.SourceScope = maskClientAddress(address, edns0Subnet.SourceNetmask), 0
+		defer func() {
+			edns0Subnet.Address, edns0Subnet.SourceScope = address, scope
+		}()
+	}
+	return r.Pack()
+}
+
 func (c *Client) parseResponseIETF(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, isTCP bool, req *DNSRequest) {
 	if req.response.StatusCode != http.StatusOK {
 		log.Printf("HTTP error from upstream %s: %s\n", req.currentUpstream, req.response.Status)
@@ -214,19 +209,14 @@ func (c *Client) parseResponseIETF(ctx context.Context, w dns.ResponseWriter, r
 	}
 
 	fullReply.Id = r.Id
-	for _, rr := range fullReply.Answer {
-		_ = fixRecordTTL(rr, timeDelta)
-	}
-	for _, rr := range fullReply.Ns {
-		_ = fixRecordTTL(rr, timeDelta)
-	}
-	for _, rr := range fullReply.Extra {
-		if rr.Header().Rrtype == dns.TypeOPT {
-			continue
-		}
-		_ = fixRecordTTL(rr, timeDelta)
+	if len(fullReply.Question) == 1 && strings.EqualFold(fullReply.Question[0].Name, r.Question[0].Name) {
+		fullReply.Question[0].Name = r.Question[0].Name
 	}
+	dnsutil.AdjustTTL(fullReply, timeDelta)
+	c.rotateAnswers(fullReply)
+	c.applyADPolicy(fullReply)
 
+	fullReply.Compress = c.compression.compress(w.RemoteAddr())
 	buf, err := fullReply.Pack()
 	if err != nil {
 		log.Println(err)
@@ -245,15 +235,3 @@ func (c *Client) parseResponseIETF(ctx context.Context, w dns.ResponseWriter, r
 	}
 	w.Write(buf)
 }
-
-func fixRecordTTL(rr dns.RR, delta time.Duration) dns.RR {
-	rrHeader := rr.Header()
-	oldTTL := time.Duration(rrHeader.Ttl) * time.Second
-	newTTL := oldTTL - delta
-	if newTTL > 0 {
-		rrHeader.Ttl = uint32(newTTL / time.Second)
-	} else {
-		rrHeader.Ttl = 0
-	}
-	return rr
-}
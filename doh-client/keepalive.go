@@ -0,0 +1,60 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"github.com/m13253/dns-over-https/internal/dnsutil"
+	"github.com/miekg/dns"
+)
+
+// keepaliveWriter adds the edns-tcp-keepalive option (RFC 7828) with the idle
+// timeout of the TCP listener to every response, so that stub resolvers know
+// how long they may keep the connection open. It is only used for TCP
+// queries that carried the option, as the RFC requires.
+type keepaliveWriter struct {
+	dns.ResponseWriter
+	c *Client
+}
+
+func (w *keepaliveWriter) WriteMsg(m *dns.Msg) error {
+	dnsutil.SetTCPKeepalive(m, w.c.tcpIdleTimeout())
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func (w *keepaliveWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return w.ResponseWriter.Write(b)
+	}
+	dnsutil.SetTCPKeepalive(m, w.c.tcpIdleTimeout())
+	m.Compress = w.c.compression.compress(w.RemoteAddr())
+	buf, err := m.Pack()
+	if err != nil {
+		return w.ResponseWriter.Write(b)
+	}
+	if _, err := w.ResponseWriter.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
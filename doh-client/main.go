@@ -32,8 +32,10 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"time"
 
 	"github.com/m13253/dns-over-https/doh-client/config"
+	"github.com/m13253/dns-over-https/internal/confwatch"
 )
 
 func checkPIDFile(pidFile string) (bool, error) {
@@ -48,6 +50,10 @@ retry:
 		if err != nil {
 			return false, err
 		}
+		if pid == uint64(os.Getpid()) {
+			// restarted in place after a configuration change
+			return true, nil
+		}
 		_, err = os.Stat(fmt.Sprintf("/proc/%d", pid))
 		if os.IsNotExist(err) {
 			err = os.Remove(pidFile)
@@ -75,6 +81,8 @@ func main() {
 	confPath := flag.String("conf", "doh-client.conf", "Configuration file")
 	verbose := flag.Bool("verbose", false, "Enable logging")
 	showVersion := flag.Bool("version", false, "Show software version and exit")
+	showReport := flag.Bool("report", false, "Print the upstream report of a running doh-client and exit")
+	bundleKey := flag.String("bundle-key", "", "Public key to verify the configuration with, -conf is then loaded as a signed bundle")
 	var pidFile *string
 
 	// I really want to push the technology forward by recommending cgroup-based
@@ -103,11 +111,29 @@ func main() {
 		}
 	}
 
-	conf, err := config.LoadConfig(*confPath)
+	loadConfig := config.LoadConfig
+	if *bundleKey != "" {
+		loadConfig = func(path string) (*config.Config, error) {
+			return config.LoadBundle(path, *bundleKey)
+		}
+	}
+
+	conf, err := loadConfig(*confPath)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
+	if *showReport {
+		if conf.Other.MetricsListen == "" {
+			log.Fatalln("-report needs metrics_listen to be set in the configuration")
+		}
+		err = printReport(conf.Other.MetricsListen)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	if *verbose {
 		conf.Other.Verbose = true
 	}
@@ -116,5 +142,12 @@ func main() {
 	if err != nil {
 		log.Fatalln(err)
 	}
+
+	if conf.Other.ConfigReloadInterval != 0 {
+		go confwatch.Watch(*confPath, time.Duration(conf.Other.ConfigReloadInterval)*time.Second, func(path string) error {
+			_, err := loadConfig(path)
+			return err
+		})
+	}
 	_ = client.Start()
 }
@@ -0,0 +1,157 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/m13253/dns-over-https/metrics"
+	"github.com/miekg/dns"
+	"golang.org/x/net/http2"
+)
+
+var mirroredQueries = metrics.NewCounter(
+	"doh_client_mirrored_queries_total",
+	"Number of sampled queries copied to the mirror, by result.",
+	"result",
+)
+
+// mirrorQueueLength is the number of sampled queries waiting to be sent,
+// more are dropped so that a slow mirror never delays real queries
+const mirrorQueueLength = 1024
+
+// mirrorWorkers is the number of queries sent to the mirror concurrently
+const mirrorWorkers = 4
+
+// queryMirror copies a sample of queries to a secondary DoH upstream or a
+// UDP socket, e.g. to evaluate a new resolver before switching to it.
+// Responses from the mirror are discarded.
+type queryMirror struct {
+	rate       float64
+	url        string
+	udpConn    net.Conn
+	httpClient *http.Client
+	queue      chan []byte
+}
+
+// newQueryMirror sends percent% of queries to the DoH server at url, or to
+// the UDP socket at address if it is set. The mirror has its own connections,
+// so it does not compete with real queries.
+func newQueryMirror(url, address string, percent float64, timeout time.Duration, resolver *net.Resolver, tlsConfig *tls.Config) (*queryMirror, error) {
+	m := &queryMirror{
+		rate:  percent / 100,
+		url:   url,
+		queue: make(chan []byte, mirrorQueueLength),
+	}
+	if address != "" {
+		udpConn, err := net.Dial("udp", address)
+		if err != nil {
+			return nil, err
+		}
+		m.udpConn = udpConn
+	} else {
+		dialer := &net.Dialer{
+			Timeout:  timeout,
+			Resolver: resolver,
+		}
+		transport := &http.Transport{
+			DialContext:         dialer.DialContext,
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: timeout,
+		}
+		if err := http2.ConfigureTransport(transport); err != nil {
+			return nil, err
+		}
+		m.httpClient = &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+		}
+	}
+	for i := 0; i < mirrorWorkers; i++ {
+		go m.run()
+	}
+	return m, nil
+}
+
+// sample queues a copy of r with the configured probability, it never blocks
+func (m *queryMirror) sample(r *dns.Msg) {
+	if rand.Float64() >= m.rate {
+		return
+	}
+	query, err := r.Pack()
+	if err != nil {
+		mirroredQueries.Inc("error")
+		return
+	}
+	select {
+	case m.queue <- query:
+	default:
+		mirroredQueries.Inc("dropped")
+	}
+}
+
+func (m *queryMirror) run() {
+	for query := range m.queue {
+		var err error
+		if m.udpConn != nil {
+			_, err = m.udpConn.Write(query)
+		} else {
+			err = m.post(query)
+		}
+		if err != nil {
+			mirroredQueries.Inc("error")
+			continue
+		}
+		mirroredQueries.Inc("sent")
+	}
+}
+
+func (m *queryMirror) post(query []byte) error {
+	req, err := http.NewRequest(http.MethodPost, m.url, bytes.NewReader(query))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	req.Header.Set("User-Agent", USER_AGENT)
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("HTTP error from mirror %s: %s", m.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/m13253/dns-over-https/doh-client/selector"
+)
+
+// prewarmUpstream establishes a connection to upstream through the shared
+// HTTP client, so that the TLS and HTTP/2 handshakes are done before the
+// selector starts sending real queries there.
+func (c *Client) prewarmUpstream(upstream *selector.Upstream) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.conf.Other.Timeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodHead, upstream.URL, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	req.Header.Set("User-Agent", USER_AGENT)
+	req = req.WithContext(ctx)
+
+	c.httpClientMux.RLock()
+	resp, err := c.httpClient.Do(req)
+	c.httpClientMux.RUnlock()
+	if err != nil {
+		if c.conf.Other.Verbose {
+			log.Printf("failed to prewarm connection to %s: %v\n", upstream.URL, err)
+		}
+		return
+	}
+	// The status code does not matter, only the connection does
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if c.conf.Other.Verbose {
+		log.Printf("prewarmed connection to %s\n", upstream.URL)
+	}
+}
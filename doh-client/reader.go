@@ -0,0 +1,212 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/m13253/dns-over-https/metrics"
+	"github.com/miekg/dns"
+)
+
+var malformedQueries = metrics.NewCounter(
+	"doh_client_malformed_queries_total",
+	"Number of downstream packets rejected before being handled.",
+	"reason",
+)
+
+const (
+	dnsHeaderSize = 12
+	flagResponse  = 0x8000
+)
+
+var (
+	errShortHeader     = errors.New("packet shorter than a DNS header")
+	errTruncatedPacket = errors.New("packet ends inside a record")
+	errTrailingGarbage = errors.New("trailing garbage after the last record")
+)
+
+// temporaryError makes dns.Server skip the packet instead of shutting down
+type temporaryError struct {
+	error
+}
+
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// strictReader checks raw packets from downstream before miekg/dns parses
+// them, which otherwise silently drops some malformed packets and ignores
+// trailing garbage.
+type strictReader struct {
+	dns.Reader
+	maxQuerySize int
+	verbose      bool
+}
+
+func (c *Client) decorateReader(r dns.Reader) dns.Reader {
+	return &strictReader{
+		Reader:       r,
+		maxQuerySize: int(c.conf.Other.MaxQuerySize),
+		verbose:      c.conf.Other.Verbose,
+	}
+}
+
+func (sr *strictReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	m, session, err := sr.Reader.ReadUDP(conn, timeout)
+	if err != nil {
+		return m, session, err
+	}
+	if reply, ok := sr.check(m, session.RemoteAddr()); !ok {
+		if reply != nil {
+			dns.WriteToSessionUDP(conn, reply, session)
+		}
+		return nil, nil, temporaryError{errors.New("malformed query")}
+	}
+	return m, session, err
+}
+
+func (sr *strictReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	m, err := sr.Reader.ReadTCP(conn, timeout)
+	if err != nil {
+		return m, err
+	}
+	if reply, ok := sr.check(m, conn.RemoteAddr()); !ok {
+		if reply != nil {
+			buf := make([]byte, 2+len(reply))
+			binary.BigEndian.PutUint16(buf, uint16(len(reply)))
+			copy(buf[2:], reply)
+			conn.Write(buf)
+		}
+		return nil, errors.New("malformed query")
+	}
+	return m, err
+}
+
+// check reports whether m looks like a well-formed query. If not, it also
+// returns a FORMERR reply, or nil if the packet should be dropped silently.
+func (sr *strictReader) check(m []byte, remoteAddr net.Addr) (reply []byte, ok bool) {
+	var reason string
+	var err error
+	if len(m) > sr.maxQuerySize {
+		reason, err = "oversized", errors.New("packet larger than max_query_size")
+	} else if len(m) < dnsHeaderSize {
+		reason, err = "bad_header", errShortHeader
+	} else if binary.BigEndian.Uint16(m[2:])&flagResponse != 0 {
+		// Never reply to a response, otherwise two servers may loop forever
+		malformedQueries.Inc("response")
+		return nil, false
+	} else if err = checkMessageLength(m); err == errTrailingGarbage {
+		reason = "trailing_garbage"
+	} else if err != nil {
+		reason = "malformed"
+	} else {
+		return nil, true
+	}
+	malformedQueries.Inc(reason)
+	if sr.verbose {
+		log.Printf("Malformed query from %s: %s\n", remoteAddr, err)
+	}
+	if len(m) < dnsHeaderSize {
+		return nil, false
+	}
+	return formErrReply(m), false
+}
+
+// formErrReply builds a bare FORMERR reply for the query header in m
+func formErrReply(m []byte) []byte {
+	reply := make([]byte, dnsHeaderSize)
+	copy(reply, m[:4])
+	flags := binary.BigEndian.Uint16(m[2:])
+	// keep Opcode and RD, set QR and RCODE
+	flags = flags&0x7900 | flagResponse | dns.RcodeFormatError
+	binary.BigEndian.PutUint16(reply[2:], flags)
+	return reply
+}
+
+// checkMessageLength walks through all sections of m without interpreting
+// record data, to make sure the packet ends exactly after the last record.
+func checkMessageLength(m []byte) error {
+	qdcount := int(binary.BigEndian.Uint16(m[4:]))
+	rrcount := int(binary.BigEndian.Uint16(m[6:])) + int(binary.BigEndian.Uint16(m[8:])) + int(binary.BigEndian.Uint16(m[10:]))
+	off := dnsHeaderSize
+	var err error
+	for i := 0; i < qdcount; i++ {
+		off, err = skipName(m, off)
+		if err != nil {
+			return err
+		}
+		// QTYPE, QCLASS
+		off += 4
+		if off > len(m) {
+			return errTruncatedPacket
+		}
+	}
+	for i := 0; i < rrcount; i++ {
+		off, err = skipName(m, off)
+		if err != nil {
+			return err
+		}
+		// TYPE, CLASS, TTL, RDLENGTH
+		if off+10 > len(m) {
+			return errTruncatedPacket
+		}
+		off += 10 + int(binary.BigEndian.Uint16(m[off+8:]))
+		if off > len(m) {
+			return errTruncatedPacket
+		}
+	}
+	if off != len(m) {
+		return errTrailingGarbage
+	}
+	return nil
+}
+
+func skipName(m []byte, off int) (int, error) {
+	for {
+		if off >= len(m) {
+			return off, errTruncatedPacket
+		}
+		length := int(m[off])
+		switch length & 0xc0 {
+		case 0x00:
+			off++
+			if length == 0 {
+				return off, nil
+			}
+			off += length
+		case 0xc0:
+			// a compression pointer always ends the name
+			if off+2 > len(m) {
+				return off, errTruncatedPacket
+			}
+			return off + 2, nil
+		default:
+			return off, errors.New("unsupported label type")
+		}
+	}
+}
@@ -0,0 +1,272 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/m13253/dns-over-https/doh-client/selector"
+	"github.com/m13253/dns-over-https/stats"
+)
+
+const (
+	// upstream statistics are kept in hourly slots for the last 24 hours
+	reportSlotDuration = time.Hour
+	reportSlots        = 24
+)
+
+// latencyBounds are the upper bounds of the latency histogram buckets, the
+// last bucket holds everything slower
+var latencyBounds = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond,
+	30 * time.Millisecond, 50 * time.Millisecond, 75 * time.Millisecond,
+	100 * time.Millisecond, 150 * time.Millisecond, 200 * time.Millisecond,
+	300 * time.Millisecond, 500 * time.Millisecond, 750 * time.Millisecond,
+	1 * time.Second, 1500 * time.Millisecond, 2 * time.Second,
+	3 * time.Second, 5 * time.Second, 10 * time.Second,
+}
+
+type reportSlot struct {
+	start     int64 // Unix time of the start of the slot
+	successes uint64
+	failures  uint64
+	latency   []uint64 // histogram of successful queries, by latencyBounds
+}
+
+// upstreamReport summarizes one upstream over the report window.
+type upstreamReport struct {
+	Upstream    string  `json:"upstream"`
+	Queries     uint64  `json:"queries"`
+	SuccessRate float64 `json:"success_rate"`
+	P50         float64 `json:"p50_ms"`
+	P95         float64 `json:"p95_ms"`
+	P99         float64 `json:"p99_ms"`
+	Weight      *int32  `json:"weight,omitempty"`
+	Health      string  `json:"health,omitempty"`
+}
+
+// reportCollector keeps the success rate and latency of every upstream over
+// the last 24 hours, to help users decide which upstreams to keep.
+type reportCollector struct {
+	stats.Nop
+	mu        sync.Mutex
+	upstreams map[string]*[reportSlots]reportSlot
+}
+
+func newReportCollector() *reportCollector {
+	return &reportCollector{
+		upstreams: make(map[string]*[reportSlots]reportSlot),
+	}
+}
+
+// record adds the result of one query to upstream. latency is the time until
+// the response headers arrived and only counts for successful queries.
+func (rc *reportCollector) record(upstream string, ok bool, latency time.Duration, now time.Time) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	slots, exists := rc.upstreams[upstream]
+	if !exists {
+		slots = new([reportSlots]reportSlot)
+		rc.upstreams[upstream] = slots
+	}
+	start := now.Truncate(reportSlotDuration).Unix()
+	slot := &slots[(start/int64(reportSlotDuration/time.Second))%reportSlots]
+	if slot.start != start {
+		*slot = reportSlot{
+			start:   start,
+			latency: make([]uint64, len(latencyBounds)+1),
+		}
+	}
+
+	if !ok {
+		slot.failures++
+		return
+	}
+	slot.successes++
+	i := sort.Search(len(latencyBounds), func(i int) bool { return latency <= latencyBounds[i] })
+	slot.latency[i]++
+}
+
+func (rc *reportCollector) OnUpstreamResult(upstream string, ok bool, latency time.Duration) {
+	rc.record(upstream, ok, latency, time.Now())
+}
+
+// report summarizes the last 24 hours before now. weights and health hold
+// the current effective weight and health state of each upstream, if the
+// selector keeps them.
+func (rc *reportCollector) report(now time.Time, weights map[string]int32, health map[string]selector.HealthState) []upstreamReport {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	oldest := now.Add(-reportSlots * reportSlotDuration).Unix()
+	reports := make([]upstreamReport, 0, len(rc.upstreams))
+	for upstream, slots := range rc.upstreams {
+		var successes, failures uint64
+		latency := make([]uint64, len(latencyBounds)+1)
+		for i := range slots {
+			slot := &slots[i]
+			if slot.start <= oldest {
+				continue
+			}
+			successes += slot.successes
+			failures += slot.failures
+			for j, count := range slot.latency {
+				latency[j] += count
+			}
+		}
+
+		r := upstreamReport{
+			Upstream: upstream,
+			Queries:  successes + failures,
+			P50:      latencyPercentile(latency, successes, 0.50),
+			P95:      latencyPercentile(latency, successes, 0.95),
+			P99:      latencyPercentile(latency, successes, 0.99),
+		}
+		if r.Queries != 0 {
+			r.SuccessRate = float64(successes) / float64(r.Queries)
+		}
+		if weight, ok := weights[upstream]; ok {
+			r.Weight = &weight
+		}
+		if state, ok := health[upstream]; ok {
+			r.Health = state.String()
+		}
+		reports = append(reports, r)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Upstream < reports[j].Upstream
+	})
+	return reports
+}
+
+// latencyPercentile returns the upper bound in milliseconds of the histogram
+// bucket holding the q-th quantile, or 0 if there is no data
+func latencyPercentile(histogram []uint64, total uint64, q float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(total-1)) + 1
+	var seen uint64
+	for i, count := range histogram {
+		seen += count
+		if seen >= rank {
+			if i >= len(latencyBounds) {
+				i = len(latencyBounds) - 1
+			}
+			return float64(latencyBounds[i]) / float64(time.Millisecond)
+		}
+	}
+	return float64(latencyBounds[len(latencyBounds)-1]) / float64(time.Millisecond)
+}
+
+// writeReport prints reports as a table
+func writeReport(w io.Writer, reports []upstreamReport) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "UPSTREAM\tQUERIES\tSUCCESS\tP50\tP95\tP99\tWEIGHT\tHEALTH")
+	for _, r := range reports {
+		weight := "-"
+		if r.Weight != nil {
+			weight = fmt.Sprint(*r.Weight)
+		}
+		health := "-"
+		if r.Health != "" {
+			health = r.Health
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%.2f%%\t%gms\t%gms\t%gms\t%s\t%s\n", r.Upstream, r.Queries, r.SuccessRate*100, r.P50, r.P95, r.P99, weight, health)
+	}
+	tw.Flush()
+}
+
+// upstreamWeights returns the effective weights of the selector, if it has any
+func (c *Client) upstreamWeights() map[string]int32 {
+	if getter, ok := c.selector.(selector.WeightGetter); ok {
+		return getter.EffectiveWeights()
+	}
+	return nil
+}
+
+// upstreamHealth returns the health states of the selector, if it keeps them
+func (c *Client) upstreamHealth() map[string]selector.HealthState {
+	if getter, ok := c.selector.(selector.HealthGetter); ok {
+		return getter.HealthStates()
+	}
+	return nil
+}
+
+// serveReport serves the upstream report of the last 24 hours as JSON
+func (c *Client) serveReport(w http.ResponseWriter, r *http.Request) {
+	reports := c.report.report(time.Now(), c.upstreamWeights(), c.upstreamHealth())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+// logReports prints the upstream report every interval
+func (c *Client) logReports(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		reports := c.report.report(time.Now(), c.upstreamWeights(), c.upstreamHealth())
+		var b strings.Builder
+		writeReport(&b, reports)
+		log.Printf("Upstream report of the last 24 hours:\n%s", b.String())
+	}
+}
+
+// printReport fetches the report from a running doh-client through its
+// metrics listener and prints it as a table
+func printReport(metricsListen string) error {
+	host, port, err := net.SplitHostPort(metricsListen)
+	if err != nil {
+		return err
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	resp, err := http.Get("http://" + net.JoinHostPort(host, port) + "/report")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP error from %s: %s", metricsListen, resp.Status)
+	}
+	var reports []upstreamReport
+	if err := json.NewDecoder(resp.Body).Decode(&reports); err != nil {
+		return err
+	}
+	writeReport(os.Stdout, reports)
+	return nil
+}
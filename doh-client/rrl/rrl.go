@@ -0,0 +1,130 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+// Package rrl implements Response Rate Limiting for the UDP listeners, so that
+// doh-client can not be used as a reflection amplifier by spoofed queries.
+package rrl
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/m13253/dns-over-https/internal/ratelimit"
+)
+
+type Action int
+
+const (
+	// Allow means the response should be sent normally
+	Allow Action = iota
+
+	// Drop means the response should be silently dropped
+	Drop
+
+	// Slip means a truncated response should be sent instead, so that a
+	// legitimate client can retry over TCP
+	Slip
+)
+
+type Limiter struct {
+	rate        float64
+	burst       float64
+	slip        uint
+	leak        uint
+	ipv4Mask    net.IPMask
+	ipv6Mask    net.IPMask
+	mu          sync.Mutex
+	buckets     map[string]*clientBucket
+	lastCleanup time.Time
+}
+
+type clientBucket struct {
+	*ratelimit.Bucket
+	limited uint
+}
+
+// New creates a Limiter allowing responsesPerSecond responses to each client
+// network, with bursts up to window seconds worth of responses.
+//
+// Every slip-th limited response is answered with a truncated response, and
+// every leak-th limited response is answered in full. Zero disables either
+// behavior.
+func New(responsesPerSecond, window, slip, leak uint, ipv4PrefixLen, ipv6PrefixLen int) *Limiter {
+	if window == 0 {
+		window = 1
+	}
+	return &Limiter{
+		rate:     float64(responsesPerSecond),
+		burst:    float64(responsesPerSecond * window),
+		slip:     slip,
+		leak:     leak,
+		ipv4Mask: net.CIDRMask(ipv4PrefixLen, 32),
+		ipv6Mask: net.CIDRMask(ipv6PrefixLen, 128),
+		buckets:  make(map[string]*clientBucket),
+	}
+}
+
+// Check decides what to do with a response to ip.
+func (l *Limiter) Check(ip net.IP) Action {
+	var key string
+	if ipv4 := ip.To4(); ipv4 != nil {
+		key = ipv4.Mask(l.ipv4Mask).String()
+	} else {
+		key = ip.Mask(l.ipv6Mask).String()
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	if now.Sub(l.lastCleanup) > time.Minute {
+		for k, b := range l.buckets {
+			if b.Full(now) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastCleanup = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &clientBucket{
+			Bucket: ratelimit.NewBucket(l.rate, l.burst),
+		}
+		l.buckets[key] = b
+	}
+	if b.AllowAt(now) {
+		b.limited = 0
+		l.mu.Unlock()
+		return Allow
+	}
+	b.limited++
+	limited := b.limited
+	l.mu.Unlock()
+
+	if l.leak != 0 && limited%l.leak == 0 {
+		return Allow
+	}
+	if l.slip != 0 && limited%l.slip == 0 {
+		return Slip
+	}
+	return Drop
+}
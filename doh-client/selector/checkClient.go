@@ -0,0 +1,27 @@
+package selector
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// newCheckClient creates the http client used to check upstreams, dialContext may be nil
+func newCheckClient(timeout time.Duration, tlsConfig *tls.Config, dialContext DialContextFunc) http.Client {
+	transport := &http.Transport{
+		DialContext:         dialContext,
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: timeout,
+	}
+
+	// it only fails when the transport is already configured for HTTP/2
+	_ = http2.ConfigureTransport(transport)
+
+	return http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}
+}
@@ -0,0 +1,43 @@
+package selector
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// decaySteps is the number of times per half-life penalties are decayed
+const decaySteps = 4
+
+// decayPenalties lets the penalty of every upstream, the difference between
+// its weight and effective weight, fade out over time with the given
+// half-life. Without it, a penalized upstream only recovers through
+// successful probes or queries, which is slow when probes are infrequent or
+// the daemon is mostly idle.
+func decayPenalties(upstreams []*Upstream, halfLife time.Duration, best *bestTracker) {
+	ticker := time.NewTicker(halfLife / decaySteps)
+	defer ticker.Stop()
+	factor := math.Pow(0.5, 1.0/decaySteps)
+	for range ticker.C {
+		for _, upstream := range upstreams {
+			upstream.decayPenalty(factor)
+		}
+		best.update(upstreams)
+	}
+}
+
+// decayPenalty multiplies the penalty of the upstream by factor, rounding
+// down so that small penalties disappear instead of lingering forever
+func (u *Upstream) decayPenalty(factor float64) {
+	for {
+		effectiveWeight := atomic.LoadInt32(&u.effectiveWeight)
+		penalty := u.weight - effectiveWeight
+		if penalty <= 0 {
+			return
+		}
+		decayed := u.weight - int32(math.Floor(float64(penalty)*factor))
+		if atomic.CompareAndSwapInt32(&u.effectiveWeight, effectiveWeight, decayed) {
+			return
+		}
+	}
+}
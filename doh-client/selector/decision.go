@@ -0,0 +1,37 @@
+package selector
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+
+	"github.com/m13253/dns-over-https/metrics"
+)
+
+var upstreamSelections = metrics.NewCounter(
+	"doh_client_upstream_selections_total",
+	"Number of queries the selector sent to each upstream.",
+	"upstream",
+)
+
+// decisionLog counts every upstream choice and logs a sample of them together
+// with the effective weights at decision time
+type decisionLog struct {
+	sampleRate float64
+}
+
+func (dl *decisionLog) record(chosen *Upstream, upstreams []*Upstream) {
+	upstreamSelections.Inc(chosen.URL)
+
+	if dl.sampleRate <= 0 || rand.Float64() >= dl.sampleRate {
+		return
+	}
+
+	weights := make([]string, len(upstreams))
+	for i, upstream := range upstreams {
+		weights[i] = fmt.Sprintf("%s=%d", upstream.URL, atomic.LoadInt32(&upstream.effectiveWeight))
+	}
+	log.Printf("selector chose %s, effective weights: %s\n", chosen.URL, strings.Join(weights, ", "))
+}
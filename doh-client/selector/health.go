@@ -0,0 +1,199 @@
+package selector
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/m13253/dns-over-https/metrics"
+)
+
+// HealthState is the availability of an upstream. Failures to answer only
+// change the health state, while the effective weight only reflects load, so
+// an upstream which answers slowly is used less and one which doesn't answer
+// at all is not used.
+type HealthState int32
+
+const (
+	// the upstream answers
+	Healthy HealthState = iota
+
+	// recent probes or queries failed, or the upstream is recovering
+	Degraded
+
+	// the upstream can't be reached, or failed too many times in a row.
+	// Selectors skip it, except for a trial query every downRetryInterval.
+	Down
+)
+
+var healthStateNames = [...]string{
+	Healthy:  "healthy",
+	Degraded: "degraded",
+	Down:     "down",
+}
+
+func (h HealthState) String() string {
+	if h < 0 || int(h) >= len(healthStateNames) {
+		return "unknown"
+	}
+	return healthStateNames[h]
+}
+
+const (
+	// degradedAfterFailures is the number of failures in a row after which a
+	// healthy upstream is considered degraded, a single timeout is common
+	degradedAfterFailures = 2
+
+	// downAfterFailures is the number of failures in a row after which an
+	// upstream is considered down
+	downAfterFailures = 4
+
+	// healthyAfterSuccesses is the number of successes in a row after which a
+	// degraded or down upstream is considered healthy again
+	healthyAfterSuccesses = 3
+
+	// downRetryInterval is how often a down upstream may get a trial query,
+	// so that it can recover even if it is not probed
+	downRetryInterval = 30 * time.Second
+)
+
+var upstreamHealth = metrics.NewGauge(
+	"doh_client_upstream_health",
+	"Health state of each upstream, 1 for the current state and 0 for the others.",
+	"upstream", "state",
+)
+
+// upstreamHealthMux orders the updates of upstreamHealth, so that concurrent
+// changes of the health state can't leave two states set to 1
+var upstreamHealthMux sync.Mutex
+
+// Health returns the current health state of the upstream
+func (u *Upstream) Health() HealthState {
+	return HealthState(atomic.LoadInt32(&u.health))
+}
+
+func (u *Upstream) setHealth(health HealthState) {
+	old := HealthState(atomic.SwapInt32(&u.health, int32(health)))
+	if old == health {
+		return
+	}
+	u.exportHealth()
+	// only log going down and coming back, degraded upstreams may flap a lot
+	if old == Down || health == Down {
+		log.Printf("%s, health: %s -> %s", u, old, health)
+	}
+}
+
+// succeeded counts a successful probe or query, the upstream becomes healthy
+// again after healthyAfterSuccesses of them in a row
+func (u *Upstream) succeeded() {
+	atomic.StoreInt32(&u.failures, 0)
+	if atomic.AddInt32(&u.successes, 1) >= healthyAfterSuccesses {
+		u.setHealth(Healthy)
+	}
+}
+
+// failed counts a failed probe or query. The upstream becomes degraded or
+// down after enough failures in a row, or down at once if unreachable is set.
+func (u *Upstream) failed(unreachable bool) {
+	atomic.StoreInt32(&u.successes, 0)
+	failures := atomic.AddInt32(&u.failures, 1)
+	switch {
+	case unreachable || failures >= downAfterFailures:
+		if u.Health() != Down {
+			atomic.StoreInt64(&u.retryAt, time.Now().Add(downRetryInterval).UnixNano())
+		}
+		u.setHealth(Down)
+	case failures >= degradedAfterFailures && u.Health() == Healthy:
+		u.setHealth(Degraded)
+	}
+}
+
+// available reports whether the upstream may be selected: it is not down, or
+// it is time for a trial query to a down upstream
+func (u *Upstream) available(now time.Time) bool {
+	return u.Health() != Down || now.UnixNano() >= atomic.LoadInt64(&u.retryAt)
+}
+
+// chosen is called when a selector chose the upstream, so that a down upstream
+// only gets one trial query every downRetryInterval
+func (u *Upstream) chosen(now time.Time) {
+	if u.Health() == Down {
+		atomic.StoreInt64(&u.retryAt, now.Add(downRetryInterval).UnixNano())
+	}
+}
+
+// availability takes one snapshot of which upstreams are available, so that
+// a selector doesn't see a different answer in every loop iteration while
+// other goroutines report failures. If none is available, all of them are,
+// so that queries are still sent somewhere instead of all failing.
+func availability(upstreams []*Upstream, now time.Time) []bool {
+	available := make([]bool, len(upstreams))
+	anyAvailable := false
+	for i, upstream := range upstreams {
+		available[i] = upstream.available(now)
+		anyAvailable = anyAvailable || available[i]
+	}
+	if !anyAvailable {
+		for i := range available {
+			available[i] = true
+		}
+	}
+	return available
+}
+
+// updateHealthFromProbe drives the health state machine with a probe result
+func (u *Upstream) updateHealthFromProbe(result ProbeResult) {
+	switch result {
+	case ProbeOK:
+		u.succeeded()
+	case ProbeBadResponse:
+		u.failed(false)
+	case ProbeUnreachable:
+		u.failed(true)
+	}
+}
+
+// updateHealthFromStatus drives the health state machine with the result of a
+// query sent by a client. An error response means the upstream is alive but
+// overloaded, which only lowers its weight.
+func (u *Upstream) updateHealthFromStatus(status upstreamStatus) {
+	switch status {
+	case OK:
+		u.succeeded()
+	case Timeout:
+		u.failed(false)
+	}
+}
+
+// exportHealth sets all the health series of the upstream from its stored
+// state
+func (u *Upstream) exportHealth() {
+	upstreamHealthMux.Lock()
+	defer upstreamHealthMux.Unlock()
+	health := u.Health()
+	for state, name := range healthStateNames {
+		value := 0.0
+		if HealthState(state) == health {
+			value = 1
+		}
+		upstreamHealth.Set(value, u.URL, name)
+	}
+}
+
+// initHealth exports the initial health state of upstreams
+func initHealth(upstreams []*Upstream) {
+	for _, upstream := range upstreams {
+		upstream.exportHealth()
+	}
+}
+
+// healthStates returns the health state of each upstream by URL
+func healthStates(upstreams []*Upstream) map[string]HealthState {
+	states := make(map[string]HealthState, len(upstreams))
+	for _, upstream := range upstreams {
+		states[upstream.URL] = upstream.Health()
+	}
+	return states
+}
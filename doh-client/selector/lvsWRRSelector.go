@@ -1,11 +1,11 @@
 package selector
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"errors"
 	"log"
 	"net/http"
-	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -15,20 +15,31 @@ type LVSWRRSelector struct {
 	client        http.Client // http client to check the upstream
 	lastChoose    int32
 	currentWeight int32
+	best          bestTracker   // tracks the best upstream for prewarming
+	decisions     decisionLog   // counts and samples Get decisions
+	halfLife      time.Duration // half-life of penalties, 0 means they never decay
 }
 
-func NewLVSWRRSelector(timeout time.Duration) *LVSWRRSelector {
+// NewLVSWRRSelector creates the selector, dialContext is used to probe upstreams and may be nil
+func NewLVSWRRSelector(timeout time.Duration, tlsConfig *tls.Config, dialContext DialContextFunc) *LVSWRRSelector {
 	return &LVSWRRSelector{
-		client:     http.Client{Timeout: timeout},
+		client:     newCheckClient(timeout, tlsConfig, dialContext),
 		lastChoose: -1,
 	}
 }
 
-func (ls *LVSWRRSelector) Add(url string, upstreamType UpstreamType, weight int32) (err error) {
+func (ls *LVSWRRSelector) Add(url string, upstreamType UpstreamType, weight int32, probe Probe, probeInterval time.Duration) (err error) {
 	if weight < 1 {
 		return errors.New("weight is 1")
 	}
 
+	if probe == nil {
+		probe = HTTPGetProbe{}
+	}
+	if probeInterval <= 0 {
+		probeInterval = defaultProbeInterval
+	}
+
 	switch upstreamType {
 	case Google:
 		ls.upstreams = append(ls.upstreams, &Upstream{
@@ -37,6 +48,8 @@ func (ls *LVSWRRSelector) Add(url string, upstreamType UpstreamType, weight int3
 			RequestType:     "application/dns-json",
 			weight:          weight,
 			effectiveWeight: weight,
+			probe:           probe,
+			probeInterval:   probeInterval,
 		})
 
 	case IETF:
@@ -46,6 +59,8 @@ func (ls *LVSWRRSelector) Add(url string, upstreamType UpstreamType, weight int3
 			RequestType:     "application/dns-message",
 			weight:          weight,
 			effectiveWeight: weight,
+			probe:           probe,
+			probeInterval:   probeInterval,
 		})
 
 	default:
@@ -56,72 +71,70 @@ func (ls *LVSWRRSelector) Add(url string, upstreamType UpstreamType, weight int3
 }
 
 func (ls *LVSWRRSelector) StartEvaluate() {
-	go func() {
-		for {
-			wg := sync.WaitGroup{}
-
-			for i := range ls.upstreams {
-				wg.Add(1)
-
-				go func(i int) {
-					defer wg.Done()
-
-					upstreamURL := ls.upstreams[i].URL
-					var acceptType string
-
-					switch ls.upstreams[i].Type {
-					case Google:
-						upstreamURL += "?name=www.example.com&type=A"
-						acceptType = "application/dns-json"
-
-					case IETF:
-						// www.example.com
-						upstreamURL += "?dns=q80BAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB"
-						acceptType = "application/dns-message"
-					}
-
-					req, err := http.NewRequest(http.MethodGet, upstreamURL, nil)
-					if err != nil {
-						/*log.Println("upstream:", upstreamURL, "type:", typeMap[upstream.Type], "check failed:", err)
-						continue*/
-
-						// should I only log it? But if there is an error, I think when query the server will return error too
-						panic("upstream: " + upstreamURL + " type: " + typeMap[ls.upstreams[i].Type] + " check failed: " + err.Error())
-					}
-
-					req.Header.Set("accept", acceptType)
-
-					resp, err := ls.client.Do(req)
-					if err != nil {
-						// should I check error in detail?
-						if atomic.AddInt32(&ls.upstreams[i].effectiveWeight, -5) < 1 {
-							atomic.StoreInt32(&ls.upstreams[i].effectiveWeight, 1)
-						}
-						return
-					}
-
-					switch ls.upstreams[i].Type {
-					case Google:
-						ls.checkGoogleResponse(resp, ls.upstreams[i])
-
-					case IETF:
-						ls.checkIETFResponse(resp, ls.upstreams[i])
-					}
-				}(i)
+	initHealth(ls.upstreams)
+
+	if ls.halfLife > 0 {
+		go decayPenalties(ls.upstreams, ls.halfLife, &ls.best)
+	}
+
+	for _, upstream := range ls.upstreams {
+		go func(upstream *Upstream) {
+			for {
+				ls.evaluate(upstream)
+
+				time.Sleep(upstream.nextProbe())
 			}
+		}(upstream)
+	}
+}
 
-			wg.Wait()
+func (ls *LVSWRRSelector) evaluate(upstream *Upstream) {
+	ctx, cancel := context.WithTimeout(context.Background(), ls.client.Timeout)
+	defer cancel()
 
-			time.Sleep(15 * time.Second)
+	result := upstream.probe.Probe(ctx, &ls.client, upstream)
+	upstream.updateHealthFromProbe(result)
+
+	switch result {
+	case ProbeOK:
+		if atomic.AddInt32(&upstream.effectiveWeight, 5) > upstream.weight {
+			atomic.StoreInt32(&upstream.effectiveWeight, upstream.weight)
 		}
-	}()
+
+	case ProbeServerError:
+		if atomic.AddInt32(&upstream.effectiveWeight, -3) < 1 {
+			atomic.StoreInt32(&upstream.effectiveWeight, 1)
+		}
+	}
+
+	ls.best.update(ls.upstreams)
 }
 
 func (ls *LVSWRRSelector) Get() *Upstream {
+	now := time.Now()
+	upstream := ls.get(now)
+	upstream.chosen(now)
+	ls.decisions.record(upstream, ls.upstreams)
+	return upstream
+}
+
+// GetExcluding returns the upstream with the highest effective weight which is not excluded
+func (ls *LVSWRRSelector) GetExcluding(excluded map[*Upstream]bool) *Upstream {
+	return nextBest(ls.upstreams, excluded)
+}
+
+func (ls *LVSWRRSelector) SetDecisionLogSampleRate(rate float64) {
+	ls.decisions.sampleRate = rate
+}
+
+// get is the LVS weighted round-robin, down upstreams are skipped
+func (ls *LVSWRRSelector) get(now time.Time) *Upstream {
 	if len(ls.upstreams) == 1 {
 		return ls.upstreams[0]
 	}
 
+	available := availability(ls.upstreams, now)
+
 	for {
 		atomic.StoreInt32(&ls.lastChoose, (atomic.LoadInt32(&ls.lastChoose)+1)%int32(len(ls.upstreams)))
 
@@ -137,8 +150,13 @@ func (ls *LVSWRRSelector) Get() *Upstream {
 			}
 		}
 
-		if atomic.LoadInt32(&ls.upstreams[atomic.LoadInt32(&ls.lastChoose)].effectiveWeight) >= atomic.LoadInt32(&ls.currentWeight) {
-			return ls.upstreams[atomic.LoadInt32(&ls.lastChoose)]
+		index := atomic.LoadInt32(&ls.lastChoose)
+		if !available[index] {
+			continue
+		}
+		upstream := ls.upstreams[index]
+		if atomic.LoadInt32(&upstream.effectiveWeight) >= atomic.LoadInt32(&ls.currentWeight) {
+			return upstream
 		}
 	}
 }
@@ -180,12 +198,10 @@ func gcd(x, y int32) int32 {
 }
 
 func (ls *LVSWRRSelector) ReportUpstreamStatus(upstream *Upstream, upstreamStatus upstreamStatus) {
-	switch upstreamStatus {
-	case Timeout:
-		if atomic.AddInt32(&upstream.effectiveWeight, -5) < 1 {
-			atomic.StoreInt32(&upstream.effectiveWeight, 1)
-		}
+	health, weight := upstream.Health(), atomic.LoadInt32(&upstream.effectiveWeight)
+	upstream.updateHealthFromStatus(upstreamStatus)
 
+	switch upstreamStatus {
 	case Error:
 		if atomic.AddInt32(&upstream.effectiveWeight, -2) < 1 {
 			atomic.StoreInt32(&upstream.effectiveWeight, 1)
@@ -196,57 +212,28 @@ func (ls *LVSWRRSelector) ReportUpstreamStatus(upstream *Upstream, upstreamStatu
 			atomic.StoreInt32(&upstream.effectiveWeight, upstream.weight)
 		}
 	}
-}
-
-func (ls *LVSWRRSelector) checkGoogleResponse(resp *http.Response, upstream *Upstream) {
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		// server error
-		if atomic.AddInt32(&upstream.effectiveWeight, -3) < 1 {
-			atomic.StoreInt32(&upstream.effectiveWeight, 1)
-		}
-		return
-	}
-
-	m := make(map[string]interface{})
-	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
-		// should I check error in detail?
-		if atomic.AddInt32(&upstream.effectiveWeight, -2) < 1 {
-			atomic.StoreInt32(&upstream.effectiveWeight, 1)
-		}
-		return
-	}
 
-	if status, ok := m["Status"]; ok {
-		if statusNum, ok := status.(float64); ok && statusNum == 0 {
-			if atomic.AddInt32(&upstream.effectiveWeight, 5) > upstream.weight {
-				atomic.StoreInt32(&upstream.effectiveWeight, upstream.weight)
-			}
-			return
-		}
+	// this is called for every query, only look for a new best upstream if
+	// this one changed
+	if upstream.Health() != health || atomic.LoadInt32(&upstream.effectiveWeight) != weight {
+		ls.best.update(ls.upstreams)
 	}
+}
 
-	// should I check error in detail?
-	if atomic.AddInt32(&upstream.effectiveWeight, -2) < 1 {
-		atomic.StoreInt32(&upstream.effectiveWeight, 1)
-	}
+func (ls *LVSWRRSelector) HealthStates() map[string]HealthState {
+	return healthStates(ls.upstreams)
 }
 
-func (ls *LVSWRRSelector) checkIETFResponse(resp *http.Response, upstream *Upstream) {
-	defer resp.Body.Close()
+func (ls *LVSWRRSelector) EffectiveWeights() map[string]int32 {
+	return effectiveWeights(ls.upstreams)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		// server error
-		if atomic.AddInt32(&upstream.effectiveWeight, -3) < 1 {
-			atomic.StoreInt32(&upstream.effectiveWeight, 1)
-		}
-		return
-	}
+func (ls *LVSWRRSelector) SetPenaltyHalfLife(halfLife time.Duration) {
+	ls.halfLife = halfLife
+}
 
-	if atomic.AddInt32(&upstream.effectiveWeight, 5) > upstream.weight {
-		atomic.StoreInt32(&upstream.effectiveWeight, upstream.weight)
-	}
+func (ls *LVSWRRSelector) SetPrewarmFunc(prewarm func(upstream *Upstream)) {
+	ls.best.setPrewarmFunc(prewarm)
 }
 
 func (ls *LVSWRRSelector) ReportWeights() {
@@ -255,7 +242,7 @@ func (ls *LVSWRRSelector) ReportWeights() {
 			time.Sleep(15 * time.Second)
 
 			for _, u := range ls.upstreams {
-				log.Printf("%s, effect weight: %d", u, atomic.LoadInt32(&u.effectiveWeight))
+				log.Printf("%s, effect weight: %d, health: %s", u, atomic.LoadInt32(&u.effectiveWeight), u.Health())
 			}
 		}
 	}()
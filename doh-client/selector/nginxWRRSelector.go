@@ -1,27 +1,38 @@
 package selector
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"errors"
 	"log"
 	"net/http"
-	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type NginxWRRSelector struct {
-	upstreams []*Upstream // upstreamsInfo
-	client    http.Client // http client to check the upstream
+	upstreams []*Upstream   // upstreamsInfo
+	client    http.Client   // http client to check the upstream
+	best      bestTracker   // tracks the best upstream for prewarming
+	decisions decisionLog   // counts and samples Get decisions
+	halfLife  time.Duration // half-life of penalties, 0 means they never decay
 }
 
-func NewNginxWRRSelector(timeout time.Duration) *NginxWRRSelector {
+// NewNginxWRRSelector creates the selector, dialContext is used to probe upstreams and may be nil
+func NewNginxWRRSelector(timeout time.Duration, tlsConfig *tls.Config, dialContext DialContextFunc) *NginxWRRSelector {
 	return &NginxWRRSelector{
-		client: http.Client{Timeout: timeout},
+		client: newCheckClient(timeout, tlsConfig, dialContext),
 	}
 }
 
-func (ws *NginxWRRSelector) Add(url string, upstreamType UpstreamType, weight int32) (err error) {
+func (ws *NginxWRRSelector) Add(url string, upstreamType UpstreamType, weight int32, probe Probe, probeInterval time.Duration) (err error) {
+	if probe == nil {
+		probe = HTTPGetProbe{}
+	}
+	if probeInterval <= 0 {
+		probeInterval = defaultProbeInterval
+	}
+
 	switch upstreamType {
 	case Google:
 		ws.upstreams = append(ws.upstreams, &Upstream{
@@ -30,6 +41,8 @@ func (ws *NginxWRRSelector) Add(url string, upstreamType UpstreamType, weight in
 			RequestType:     "application/dns-json",
 			weight:          weight,
 			effectiveWeight: weight,
+			probe:           probe,
+			probeInterval:   probeInterval,
 		})
 
 	case IETF:
@@ -39,6 +52,8 @@ func (ws *NginxWRRSelector) Add(url string, upstreamType UpstreamType, weight in
 			RequestType:     "application/dns-message",
 			weight:          weight,
 			effectiveWeight: weight,
+			probe:           probe,
+			probeInterval:   probeInterval,
 		})
 
 	default:
@@ -49,75 +64,63 @@ func (ws *NginxWRRSelector) Add(url string, upstreamType UpstreamType, weight in
 }
 
 func (ws *NginxWRRSelector) StartEvaluate() {
-	go func() {
-		for {
-			wg := sync.WaitGroup{}
-
-			for i := range ws.upstreams {
-				wg.Add(1)
-
-				go func(i int) {
-					defer wg.Done()
-
-					upstreamURL := ws.upstreams[i].URL
-					var acceptType string
-
-					switch ws.upstreams[i].Type {
-					case Google:
-						upstreamURL += "?name=www.example.com&type=A"
-						acceptType = "application/dns-json"
-
-					case IETF:
-						// www.example.com
-						upstreamURL += "?dns=q80BAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB"
-						acceptType = "application/dns-message"
-					}
-
-					req, err := http.NewRequest(http.MethodGet, upstreamURL, nil)
-					if err != nil {
-						/*log.Println("upstream:", upstreamURL, "type:", typeMap[upstream.Type], "check failed:", err)
-						continue*/
-
-						// should I only log it? But if there is an error, I think when query the server will return error too
-						panic("upstream: " + upstreamURL + " type: " + typeMap[ws.upstreams[i].Type] + " check failed: " + err.Error())
-					}
-
-					req.Header.Set("accept", acceptType)
-
-					resp, err := ws.client.Do(req)
-					if err != nil {
-						// should I check error in detail?
-						if atomic.AddInt32(&ws.upstreams[i].effectiveWeight, -10) < 1 {
-							atomic.StoreInt32(&ws.upstreams[i].effectiveWeight, 1)
-						}
-						return
-					}
-
-					switch ws.upstreams[i].Type {
-					case Google:
-						ws.checkGoogleResponse(resp, ws.upstreams[i])
-
-					case IETF:
-						ws.checkIETFResponse(resp, ws.upstreams[i])
-					}
-				}(i)
+	initHealth(ws.upstreams)
+
+	if ws.halfLife > 0 {
+		go decayPenalties(ws.upstreams, ws.halfLife, &ws.best)
+	}
+
+	for _, upstream := range ws.upstreams {
+		go func(upstream *Upstream) {
+			for {
+				ws.evaluate(upstream)
+
+				time.Sleep(upstream.nextProbe())
 			}
+		}(upstream)
+	}
+}
 
-			wg.Wait()
+func (ws *NginxWRRSelector) evaluate(upstream *Upstream) {
+	ctx, cancel := context.WithTimeout(context.Background(), ws.client.Timeout)
+	defer cancel()
 
-			time.Sleep(15 * time.Second)
+	result := upstream.probe.Probe(ctx, &ws.client, upstream)
+	upstream.updateHealthFromProbe(result)
+
+	switch result {
+	case ProbeOK:
+		if atomic.AddInt32(&upstream.effectiveWeight, 5) > upstream.weight {
+			atomic.StoreInt32(&upstream.effectiveWeight, upstream.weight)
 		}
-	}()
+
+	case ProbeServerError:
+		delta := int32(-3)
+		if upstream.Type == IETF {
+			delta = -5
+		}
+		if atomic.AddInt32(&upstream.effectiveWeight, delta) < 1 {
+			atomic.StoreInt32(&upstream.effectiveWeight, 1)
+		}
+	}
+
+	ws.best.update(ws.upstreams)
 }
 
-// nginx wrr like
+// nginx wrr like, down upstreams are skipped
 func (ws *NginxWRRSelector) Get() *Upstream {
 	var (
 		total             int32
 		bestUpstreamIndex = -1
+		now               = time.Now()
+		available         = availability(ws.upstreams, now)
 	)
 
 	for i := range ws.upstreams {
+		if !available[i] {
+			continue
+		}
+
 		effectiveWeight := atomic.LoadInt32(&ws.upstreams[i].effectiveWeight)
 		atomic.AddInt32(&ws.upstreams[i].currentWeight, effectiveWeight)
 		total += effectiveWeight
@@ -128,17 +131,27 @@ func (ws *NginxWRRSelector) Get() *Upstream {
 	}
 
 	atomic.AddInt32(&ws.upstreams[bestUpstreamIndex].currentWeight, -total)
+	ws.upstreams[bestUpstreamIndex].chosen(now)
+
+	ws.decisions.record(ws.upstreams[bestUpstreamIndex], ws.upstreams)
 
 	return ws.upstreams[bestUpstreamIndex]
 }
 
+// GetExcluding returns the upstream with the highest effective weight which is not excluded
+func (ws *NginxWRRSelector) GetExcluding(excluded map[*Upstream]bool) *Upstream {
+	return nextBest(ws.upstreams, excluded)
+}
+
+func (ws *NginxWRRSelector) SetDecisionLogSampleRate(rate float64) {
+	ws.decisions.sampleRate = rate
+}
+
 func (ws *NginxWRRSelector) ReportUpstreamStatus(upstream *Upstream, upstreamStatus upstreamStatus) {
-	switch upstreamStatus {
-	case Timeout:
-		if atomic.AddInt32(&upstream.effectiveWeight, -5) < 1 {
-			atomic.StoreInt32(&upstream.effectiveWeight, 1)
-		}
+	health, weight := upstream.Health(), atomic.LoadInt32(&upstream.effectiveWeight)
+	upstream.updateHealthFromStatus(upstreamStatus)
 
+	switch upstreamStatus {
 	case Error:
 		if atomic.AddInt32(&upstream.effectiveWeight, -3) < 1 {
 			atomic.StoreInt32(&upstream.effectiveWeight, 1)
@@ -149,57 +162,28 @@ func (ws *NginxWRRSelector) ReportUpstreamStatus(upstream *Upstream, upstreamSta
 			atomic.StoreInt32(&upstream.effectiveWeight, upstream.weight)
 		}
 	}
-}
-
-func (ws *NginxWRRSelector) checkGoogleResponse(resp *http.Response, upstream *Upstream) {
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		// server error
-		if atomic.AddInt32(&upstream.effectiveWeight, -3) < 1 {
-			atomic.StoreInt32(&upstream.effectiveWeight, 1)
-		}
-		return
-	}
-
-	m := make(map[string]interface{})
-	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
-		// should I check error in detail?
-		if atomic.AddInt32(&upstream.effectiveWeight, -2) < 1 {
-			atomic.StoreInt32(&upstream.effectiveWeight, 1)
-		}
-		return
-	}
 
-	if status, ok := m["Status"]; ok {
-		if statusNum, ok := status.(float64); ok && statusNum == 0 {
-			if atomic.AddInt32(&upstream.effectiveWeight, 5) > upstream.weight {
-				atomic.StoreInt32(&upstream.effectiveWeight, upstream.weight)
-			}
-			return
-		}
+	// this is called for every query, only look for a new best upstream if
+	// this one changed
+	if upstream.Health() != health || atomic.LoadInt32(&upstream.effectiveWeight) != weight {
+		ws.best.update(ws.upstreams)
 	}
+}
 
-	// should I check error in detail?
-	if atomic.AddInt32(&upstream.effectiveWeight, -2) < 1 {
-		atomic.StoreInt32(&upstream.effectiveWeight, 1)
-	}
+func (ws *NginxWRRSelector) HealthStates() map[string]HealthState {
+	return healthStates(ws.upstreams)
 }
 
-func (ws *NginxWRRSelector) checkIETFResponse(resp *http.Response, upstream *Upstream) {
-	defer resp.Body.Close()
+func (ws *NginxWRRSelector) EffectiveWeights() map[string]int32 {
+	return effectiveWeights(ws.upstreams)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		// server error
-		if atomic.AddInt32(&upstream.effectiveWeight, -5) < 1 {
-			atomic.StoreInt32(&upstream.effectiveWeight, 1)
-		}
-		return
-	}
+func (ws *NginxWRRSelector) SetPenaltyHalfLife(halfLife time.Duration) {
+	ws.halfLife = halfLife
+}
 
-	if atomic.AddInt32(&upstream.effectiveWeight, 5) > upstream.weight {
-		atomic.StoreInt32(&upstream.effectiveWeight, upstream.weight)
-	}
+func (ws *NginxWRRSelector) SetPrewarmFunc(prewarm func(upstream *Upstream)) {
+	ws.best.setPrewarmFunc(prewarm)
 }
 
 func (ws *NginxWRRSelector) ReportWeights() {
@@ -208,7 +192,7 @@ func (ws *NginxWRRSelector) ReportWeights() {
 			time.Sleep(15 * time.Second)
 
 			for _, u := range ws.upstreams {
-				log.Printf("%s, effect weight: %d", u, atomic.LoadInt32(&u.effectiveWeight))
+				log.Printf("%s, effect weight: %d, health: %s", u, atomic.LoadInt32(&u.effectiveWeight), u.Health())
 			}
 		}
 	}()
@@ -0,0 +1,45 @@
+package selector
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// bestTracker remembers the upstream with the highest effective weight which
+// is not down, and calls prewarm in a new goroutine when it changes
+type bestTracker struct {
+	mu      sync.Mutex
+	best    *Upstream
+	prewarm func(upstream *Upstream)
+}
+
+func (bt *bestTracker) setPrewarmFunc(prewarm func(upstream *Upstream)) {
+	bt.mu.Lock()
+	bt.prewarm = prewarm
+	bt.mu.Unlock()
+}
+
+func (bt *bestTracker) update(upstreams []*Upstream) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	if bt.prewarm == nil {
+		return
+	}
+
+	var best *Upstream
+	for _, upstream := range upstreams {
+		if upstream.Health() == Down {
+			continue
+		}
+		if best == nil || atomic.LoadInt32(&upstream.effectiveWeight) > atomic.LoadInt32(&best.effectiveWeight) {
+			best = upstream
+		}
+	}
+
+	if best == nil || best == bt.best {
+		return
+	}
+	bt.best = best
+	go bt.prewarm(best)
+}
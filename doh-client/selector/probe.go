@@ -0,0 +1,279 @@
+package selector
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// ProbeResult is the outcome of a health-check probe, the selector turns it into a health state
+// change, or a weight change if the upstream is overloaded
+type ProbeResult int
+
+const (
+	// the upstream is healthy
+	ProbeOK ProbeResult = iota
+
+	// the upstream answered, but the answer is not usable
+	ProbeBadResponse
+
+	// the upstream returned a non-200 HTTP response, it is alive but probably overloaded
+	ProbeServerError
+
+	// the upstream can't be reached at all
+	ProbeUnreachable
+)
+
+type Probe interface {
+	// Probe checks the upstream, client is the http client used to check upstreams
+	Probe(ctx context.Context, client *http.Client, upstream *Upstream) ProbeResult
+}
+
+// DialContextFunc opens connections to upstreams, it should be the same as the one used for queries,
+// so that probes take the same path through the bootstrap resolver and address cache
+type DialContextFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// NewProbe returns the probe with the given name, an empty name means http_get.
+// dialContext is used by the probes which open connections themselves, nil means a plain net.Dialer.
+func NewProbe(name string, tlsConfig *tls.Config, dialContext DialContextFunc) (Probe, error) {
+	switch name {
+	case "", "http_get":
+		return HTTPGetProbe{}, nil
+	case "http_post":
+		return HTTPPostProbe{}, nil
+	case "tcp_connect":
+		return TCPConnectProbe{DialContext: dialContext}, nil
+	case "tls_handshake":
+		return TLSHandshakeProbe{TLSConfig: tlsConfig, DialContext: dialContext}, nil
+	case "dns_query":
+		return FullDNSQueryProbe{}, nil
+	default:
+		return nil, errors.New("unknown probe: " + name)
+	}
+}
+
+// probeQuery is the query for www.example.com A used by the HTTP probes
+var probeQuery = []byte{
+	0xab, 0xcd, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x03, 'w', 'w', 'w', 0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+	0x00, 0x01, 0x00, 0x01,
+}
+
+// HTTPGetProbe sends a query with GET and only checks the HTTP status,
+// plus the DNS status for Google upstreams
+type HTTPGetProbe struct{}
+
+func (HTTPGetProbe) Probe(ctx context.Context, client *http.Client, upstream *Upstream) ProbeResult {
+	resp, err := probeGet(ctx, client, upstream)
+	if err != nil {
+		return ProbeUnreachable
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ProbeServerError
+	}
+
+	if upstream.Type == Google {
+		return checkGoogleStatus(resp, false)
+	}
+	return ProbeOK
+}
+
+// HTTPPostProbe sends a query with POST and only checks the HTTP status.
+// Google upstreams have no POST API, they are probed like HTTPGetProbe.
+type HTTPPostProbe struct{}
+
+func (HTTPPostProbe) Probe(ctx context.Context, client *http.Client, upstream *Upstream) ProbeResult {
+	if upstream.Type == Google {
+		return HTTPGetProbe{}.Probe(ctx, client, upstream)
+	}
+
+	resp, err := probePost(ctx, client, upstream)
+	if err != nil {
+		return ProbeUnreachable
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ProbeServerError
+	}
+	return ProbeOK
+}
+
+// TCPConnectProbe only checks that a TCP connection to the upstream can be opened,
+// or to the proxy for the upstream if there is one
+type TCPConnectProbe struct {
+	DialContext DialContextFunc
+}
+
+func (p TCPConnectProbe) Probe(ctx context.Context, client *http.Client, upstream *Upstream) ProbeResult {
+	connected, _ := probeConnection(ctx, p.DialContext, nil, upstream, false)
+	if !connected {
+		return ProbeUnreachable
+	}
+	return ProbeOK
+}
+
+// TLSHandshakeProbe checks that a TLS handshake with the upstream succeeds,
+// through the proxy for the upstream if there is one
+type TLSHandshakeProbe struct {
+	TLSConfig   *tls.Config
+	DialContext DialContextFunc
+}
+
+func (p TLSHandshakeProbe) Probe(ctx context.Context, client *http.Client, upstream *Upstream) ProbeResult {
+	_, established := probeConnection(ctx, p.DialContext, p.TLSConfig, upstream, true)
+	if !established {
+		return ProbeUnreachable
+	}
+	return ProbeOK
+}
+
+// probeConnection opens a new connection to the upstream with an http.Transport, so that it takes the
+// same path as queries, including any proxy from the environment, but doesn't send a request on it.
+// connected reports that the first hop, the upstream or its proxy, accepted the TCP connection, and
+// established that the connection to the upstream is ready for requests, which means the TLS
+// handshake with the upstream succeeded for https URLs. With handshake unset, the attempt is aborted
+// as soon as it is connected.
+func probeConnection(ctx context.Context, dialContext DialContextFunc, tlsConfig *tls.Config, upstream *Upstream, handshake bool) (connected, established bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if dialContext == nil {
+		var dialer net.Dialer
+		dialContext = dialer.DialContext
+	}
+	var connectedFlag, establishedFlag int32
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dialContext(ctx, network, address)
+			if err == nil {
+				atomic.StoreInt32(&connectedFlag, 1)
+				if !handshake {
+					cancel()
+				}
+			}
+			return conn, err
+		},
+		Proxy:             http.ProxyFromEnvironment,
+		TLSClientConfig:   tlsConfig,
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			atomic.StoreInt32(&establishedFlag, 1)
+			cancel()
+		},
+	}
+	req, err := http.NewRequest(http.MethodHead, upstream.URL, nil)
+	if err != nil {
+		return false, false
+	}
+	resp, err := transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(ctx, trace)))
+	if err == nil {
+		resp.Body.Close()
+	}
+	return atomic.LoadInt32(&connectedFlag) != 0, atomic.LoadInt32(&establishedFlag) != 0
+}
+
+// FullDNSQueryProbe sends a query and checks that it is resolved with at least one answer
+type FullDNSQueryProbe struct{}
+
+func (FullDNSQueryProbe) Probe(ctx context.Context, client *http.Client, upstream *Upstream) ProbeResult {
+	resp, err := probeGet(ctx, client, upstream)
+	if err != nil {
+		return ProbeUnreachable
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ProbeServerError
+	}
+
+	if upstream.Type == Google {
+		return checkGoogleStatus(resp, true)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ProbeBadResponse
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(body); err != nil {
+		return ProbeBadResponse
+	}
+	if msg.Rcode != dns.RcodeSuccess || len(msg.Answer) == 0 {
+		return ProbeBadResponse
+	}
+	return ProbeOK
+}
+
+func probeGet(ctx context.Context, client *http.Client, upstream *Upstream) (*http.Response, error) {
+	upstreamURL := upstream.URL
+	var acceptType string
+
+	switch upstream.Type {
+	case Google:
+		upstreamURL += "?name=www.example.com&type=A"
+		acceptType = "application/dns-json"
+
+	case IETF:
+		// www.example.com
+		upstreamURL += "?dns=q80BAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB"
+		acceptType = "application/dns-message"
+	}
+
+	req, err := http.NewRequest(http.MethodGet, upstreamURL, nil)
+	if err != nil {
+		// should I only log it? But if there is an error, I think when query the server will return error too
+		panic("upstream: " + upstreamURL + " type: " + typeMap[upstream.Type] + " check failed: " + err.Error())
+	}
+
+	req.Header.Set("accept", acceptType)
+
+	return client.Do(req.WithContext(ctx))
+}
+
+func probePost(ctx context.Context, client *http.Client, upstream *Upstream) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, upstream.URL, bytes.NewReader(probeQuery))
+	if err != nil {
+		panic("upstream: " + upstream.URL + " type: " + typeMap[upstream.Type] + " check failed: " + err.Error())
+	}
+
+	req.Header.Set("accept", "application/dns-message")
+	req.Header.Set("content-type", "application/dns-message")
+
+	return client.Do(req.WithContext(ctx))
+}
+
+// checkGoogleStatus checks the JSON response of a Google upstream
+func checkGoogleStatus(resp *http.Response, needAnswer bool) ProbeResult {
+	var m struct {
+		Status *float64
+		Answer []json.RawMessage
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		// should I check error in detail?
+		return ProbeBadResponse
+	}
+
+	if m.Status == nil || *m.Status != 0 {
+		return ProbeBadResponse
+	}
+	if needAnswer && len(m.Answer) == 0 {
+		return ProbeBadResponse
+	}
+	return ProbeOK
+}
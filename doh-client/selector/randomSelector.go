@@ -12,6 +12,7 @@ func init() {
 
 type RandomSelector struct {
 	upstreams []*Upstream
+	decisions decisionLog // counts and samples Get decisions
 }
 
 func NewRandomSelector() *RandomSelector {
@@ -41,10 +42,59 @@ func (rs *RandomSelector) Add(url string, upstreamType UpstreamType) (err error)
 	return nil
 }
 
+// Get returns a random upstream which is not down
 func (rs *RandomSelector) Get() *Upstream {
-	return rs.upstreams[rand.Intn(len(rs.upstreams))]
+	now := time.Now()
+	available := availability(rs.upstreams, now)
+	candidates := make([]*Upstream, 0, len(rs.upstreams))
+	for i, upstream := range rs.upstreams {
+		if available[i] {
+			candidates = append(candidates, upstream)
+		}
+	}
+
+	upstream := candidates[rand.Intn(len(candidates))]
+	upstream.chosen(now)
+	rs.decisions.record(upstream, rs.upstreams)
+	return upstream
 }
 
-func (rs *RandomSelector) StartEvaluate() {}
+// GetExcluding returns a random upstream which is not excluded, preferring upstreams which are not down
+func (rs *RandomSelector) GetExcluding(excluded map[*Upstream]bool) *Upstream {
+	now := time.Now()
+	var available, down []*Upstream
+	for _, upstream := range rs.upstreams {
+		switch {
+		case excluded[upstream]:
+		case upstream.available(now):
+			available = append(available, upstream)
+		default:
+			down = append(down, upstream)
+		}
+	}
+	if len(available) == 0 {
+		available = down
+	}
+	if len(available) == 0 {
+		return nil
+	}
+	return available[rand.Intn(len(available))]
+}
 
-func (rs *RandomSelector) ReportUpstreamStatus(upstream *Upstream, upstreamStatus upstreamStatus) {}
+func (rs *RandomSelector) SetDecisionLogSampleRate(rate float64) {
+	rs.decisions.sampleRate = rate
+}
+
+// StartEvaluate only exports the health states, random selector doesn't probe upstreams
+func (rs *RandomSelector) StartEvaluate() {
+	initHealth(rs.upstreams)
+}
+
+// ReportUpstreamStatus only updates the health state, random selector has no weights
+func (rs *RandomSelector) ReportUpstreamStatus(upstream *Upstream, upstreamStatus upstreamStatus) {
+	upstream.updateHealthFromStatus(upstreamStatus)
+}
+
+func (rs *RandomSelector) HealthStates() map[string]HealthState {
+	return healthStates(rs.upstreams)
+}
@@ -1,9 +1,15 @@
 package selector
 
+import "time"
+
 type Selector interface {
 	// Get returns a upstream
 	Get() *Upstream
 
+	// GetExcluding returns the next-best upstream which is not in excluded, or nil if all are excluded,
+	// it doesn't affect the choices of Get and is not counted as a decision
+	GetExcluding(excluded map[*Upstream]bool) *Upstream
+
 	// StartEvaluate start upstream evaluation loop
 	StartEvaluate()
 
@@ -15,3 +21,30 @@ type DebugReporter interface {
 	// ReportWeights starts a goroutine to report all upstream weights, recommend interval is 15s
 	ReportWeights()
 }
+
+type Prewarmer interface {
+	// SetPrewarmFunc sets a function called with the new best upstream whenever it changes,
+	// so that a connection can be established before queries move to it
+	SetPrewarmFunc(prewarm func(upstream *Upstream))
+}
+
+type DecisionLogger interface {
+	// SetDecisionLogSampleRate logs the given fraction of Get decisions with the weights at that time
+	SetDecisionLogSampleRate(rate float64)
+}
+
+type WeightGetter interface {
+	// EffectiveWeights returns the current effective weight of every upstream by URL
+	EffectiveWeights() map[string]int32
+}
+
+type HealthGetter interface {
+	// HealthStates returns the current health state of every upstream by URL
+	HealthStates() map[string]HealthState
+}
+
+type PenaltyDecayer interface {
+	// SetPenaltyHalfLife lets the penalties of upstreams fade out over time with the given half-life,
+	// it must be called before StartEvaluate
+	SetPenaltyHalfLife(halfLife time.Duration)
+}
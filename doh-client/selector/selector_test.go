@@ -0,0 +1,117 @@
+package selector
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestSelectors returns one selector of each kind with the same upstreams
+func newTestSelectors(t *testing.T, urls ...string) map[string]Selector {
+	nginx := NewNginxWRRSelector(time.Second, nil, nil)
+	lvs := NewLVSWRRSelector(time.Second, nil, nil)
+	random := NewRandomSelector()
+	for i, url := range urls {
+		weight := int32(10 * (i + 1))
+		if err := nginx.Add(url, IETF, weight, nil, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := lvs.Add(url, IETF, weight, nil, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := random.Add(url, IETF); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return map[string]Selector{
+		"nginx-wrr": nginx,
+		"lvs-wrr":   lvs,
+		"random":    random,
+	}
+}
+
+func upstreamsOf(s Selector) []*Upstream {
+	switch s := s.(type) {
+	case *NginxWRRSelector:
+		return s.upstreams
+	case *LVSWRRSelector:
+		return s.upstreams
+	case *RandomSelector:
+		return s.upstreams
+	}
+	return nil
+}
+
+func TestGetSkipsDown(t *testing.T) {
+	for name, s := range newTestSelectors(t, "https://a/dns-query", "https://b/dns-query") {
+		upstreams := upstreamsOf(s)
+		upstreams[1].failed(true)
+		for i := 0; i < 20; i++ {
+			if got := s.Get(); got != upstreams[0] {
+				t.Fatalf("%s: Get() = %s, want the upstream which is not down", name, got.URL)
+			}
+		}
+	}
+}
+
+func TestGetAllDown(t *testing.T) {
+	for name, s := range newTestSelectors(t, "https://a/dns-query", "https://b/dns-query") {
+		for _, upstream := range upstreamsOf(s) {
+			upstream.failed(true)
+		}
+		for i := 0; i < 20; i++ {
+			if got := s.Get(); got == nil {
+				t.Fatalf("%s: Get() = nil with all upstreams down", name)
+			}
+		}
+	}
+}
+
+// TestGetWhileFlapping calls Get while other goroutines keep taking the
+// upstreams down and up again. It fails by panicking or by timing out.
+func TestGetWhileFlapping(t *testing.T) {
+	for name, s := range newTestSelectors(t, "https://a/dns-query", "https://b/dns-query") {
+		upstreams := upstreamsOf(s)
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// take all of them down at once, so that Get sees none
+				// available if it looks again after deciding to skip down ones
+				for _, upstream := range upstreams {
+					upstream.failed(true)
+				}
+				for _, upstream := range upstreams {
+					for i := 0; i < healthyAfterSuccesses; i++ {
+						upstream.succeeded()
+					}
+				}
+			}
+		}()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100000; i++ {
+				if s.Get() == nil {
+					t.Errorf("%s: Get() = nil", name)
+					return
+				}
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Errorf("%s: Get() didn't return", name)
+		}
+		close(stop)
+		wg.Wait()
+	}
+}
@@ -1,6 +1,11 @@
 package selector
 
-import "fmt"
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
 
 type UpstreamType int
 
@@ -15,14 +20,79 @@ var typeMap = map[UpstreamType]string{
 }
 
 type Upstream struct {
+	retryAt         int64 // UnixNano after which a down upstream gets a trial query, first for 64-bit alignment
 	Type            UpstreamType
 	URL             string
 	RequestType     string
 	weight          int32
 	effectiveWeight int32
 	currentWeight   int32
+	probe           Probe
+	probeInterval   time.Duration
+	inflight        int32
+	health          int32 // HealthState
+	failures        int32 // failed probes or queries in a row
+	successes       int32 // successful probes or queries in a row
 }
 
-func (u Upstream) String() string {
+// defaultProbeInterval is used when an upstream has no probe interval
+const defaultProbeInterval = 15 * time.Second
+
+// probeJitter is the fraction probe intervals are varied by in either
+// direction, to spread the probes of many clients over time
+const probeJitter = 0.1
+
+// nextProbe returns how long to wait before probing the upstream again
+func (u *Upstream) nextProbe() time.Duration {
+	return u.probeInterval + time.Duration(probeJitter*(2*rand.Float64()-1)*float64(u.probeInterval))
+}
+
+func (u *Upstream) String() string {
 	return fmt.Sprintf("upstream type: %s, upstream url: %s", typeMap[u.Type], u.URL)
 }
+
+// effectiveWeights returns the effective weight of each upstream by URL
+func effectiveWeights(upstreams []*Upstream) map[string]int32 {
+	weights := make(map[string]int32, len(upstreams))
+	for _, upstream := range upstreams {
+		weights[upstream.URL] = atomic.LoadInt32(&upstream.effectiveWeight)
+	}
+	return weights
+}
+
+// nextBest returns the upstream with the highest effective weight which is
+// not in excluded, preferring upstreams which are not down
+func nextBest(upstreams []*Upstream, excluded map[*Upstream]bool) *Upstream {
+	var (
+		best          *Upstream
+		bestAvailable bool
+		now           = time.Now()
+	)
+	for _, upstream := range upstreams {
+		if excluded[upstream] {
+			continue
+		}
+		available := upstream.available(now)
+		if best == nil || (available && !bestAvailable) ||
+			(available == bestAvailable && atomic.LoadInt32(&upstream.effectiveWeight) > atomic.LoadInt32(&best.effectiveWeight)) {
+			best = upstream
+			bestAvailable = available
+		}
+	}
+	return best
+}
+
+// TryAcquire reserves a slot for a request to the upstream if it has less
+// than max requests in flight, max <= 0 means no limit
+func (u *Upstream) TryAcquire(max int32) bool {
+	if atomic.AddInt32(&u.inflight, 1) > max && max > 0 {
+		atomic.AddInt32(&u.inflight, -1)
+		return false
+	}
+	return true
+}
+
+// Release frees the slot reserved by TryAcquire
+func (u *Upstream) Release() {
+	atomic.AddInt32(&u.inflight, -1)
+}
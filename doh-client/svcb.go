@@ -0,0 +1,225 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/m13253/dns-over-https/doh-client/selector"
+	"github.com/m13253/dns-over-https/metrics"
+	"github.com/miekg/dns"
+)
+
+// RR types of SVCB and HTTPS records (RFC 9460), which older versions of
+// miekg/dns only know as unknown types
+const (
+	typeSVCB  = 64
+	typeHTTPS = 65
+)
+
+// maxSVCBPrefetchTargets limits the number of names prefetched for one answer
+const maxSVCBPrefetchTargets = 4
+
+var svcbPrefetchQueries = metrics.NewCounter(
+	"doh_client_svcb_prefetch_queries_total",
+	"Number of A and AAAA queries sent ahead of time for the targets of SVCB and HTTPS answers.",
+	"qtype",
+)
+
+// svcbPrefetchWriter passes the reply to an SVCB or HTTPS query through, and
+// then prefetches the addresses of the target names in the reply, so that
+// the upstream has them cached by the time a browser follows the record
+type svcbPrefetchWriter struct {
+	dns.ResponseWriter
+	c *Client
+}
+
+func (w *svcbPrefetchWriter) WriteMsg(m *dns.Msg) error {
+	w.prefetch(m)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func (w *svcbPrefetchWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err == nil {
+		w.prefetch(m)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *svcbPrefetchWriter) prefetch(m *dns.Msg) {
+	if m.Rcode != dns.RcodeSuccess || m.Truncated {
+		return
+	}
+	targets := svcbTargets(m)
+	if len(targets) == 0 {
+		return
+	}
+	if w.c.conf.Other.Verbose {
+		log.Printf("prefetching addresses of SVCB targets: %s\n", strings.Join(targets, ", "))
+	}
+	// the prefetch queries are sent as if from the same client, so that they
+	// carry the same EDNS0-Client-Subnet as the query of the browser will
+	discard := &discardWriter{ResponseWriter: w.ResponseWriter}
+	noIPv6 := w.c.conf.Other.NoIPv6
+	go func() {
+		for _, target := range targets {
+			for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				if qtype == dns.TypeAAAA && noIPv6 {
+					continue
+				}
+				r := new(dns.Msg)
+				r.SetQuestion(target, qtype)
+				svcbPrefetchQueries.Inc(dns.TypeToString[qtype])
+				w.c.prefetchQuery(discard, r)
+			}
+		}
+	}()
+}
+
+// prefetchQuery sends a query made up by doh-client itself to an upstream and
+// throws the answer away. Unlike handlerFunc, it is not counted in the
+// statistics, not mirrored, and doesn't wait for pacing or take an admission
+// slot, so that prefetching never delays or sheds the queries of clients.
+func (c *Client) prefetchQuery(w dns.ResponseWriter, r *dns.Msg) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.conf.Other.Timeout)*time.Second)
+	defer cancel()
+
+	upstream := c.selector.Get()
+	if !upstream.TryAcquire(int32(c.conf.Upstream.MaxInflightPerUpstream)) {
+		// don't spill over to other upstreams for a query nobody waits for
+		return
+	}
+	defer upstream.Release()
+
+	var req *DNSRequest
+	switch upstream.RequestType {
+	case "application/dns-json":
+		req = c.generateRequestGoogle(ctx, w, r, false, upstream)
+
+	case "application/dns-message":
+		req = c.generateRequestIETF(ctx, w, r, false, upstream)
+
+	default:
+		panic("Unknown request Content-Type")
+	}
+	if req.err != nil {
+		if urlErr, ok := req.err.(*url.Error); ok && urlErr.Timeout() {
+			c.selector.ReportUpstreamStatus(upstream, selector.Timeout)
+		}
+		return
+	}
+	// read the body to the end, so that the connection can be reused
+	io.Copy(ioutil.Discard, req.response.Body)
+	req.response.Body.Close()
+
+	switch req.response.StatusCode / 100 {
+	case 5:
+		c.selector.ReportUpstreamStatus(upstream, selector.Error)
+
+	case 2:
+		c.selector.ReportUpstreamStatus(upstream, selector.OK)
+	}
+}
+
+// svcbTargets returns the distinct target names of the SVCB and HTTPS records
+// in the answer section of m
+func svcbTargets(m *dns.Msg) []string {
+	var targets []string
+	seen := make(map[string]bool)
+	for _, rr := range m.Answer {
+		rrType := rr.Header().Rrtype
+		if rrType != typeSVCB && rrType != typeHTTPS {
+			continue
+		}
+		priority, target, ok := parseSVCBTarget(rr)
+		if !ok {
+			continue
+		}
+		if target == "." {
+			if priority == 0 {
+				// AliasMode with "." means the service doesn't exist
+				continue
+			}
+			// ServiceMode with "." means the owner name itself
+			target = rr.Header().Name
+		}
+		target = strings.ToLower(target)
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+		targets = append(targets, target)
+		if len(targets) >= maxSVCBPrefetchTargets {
+			break
+		}
+	}
+	return targets
+}
+
+// parseSVCBTarget returns the SvcPriority and TargetName of an SVCB or HTTPS
+// record. It reads them from the wire format, which is the same whether
+// miekg/dns knows the type or keeps it as RFC 3597 unknown data.
+func parseSVCBTarget(rr dns.RR) (priority uint16, target string, ok bool) {
+	buf := make([]byte, dns.MaxMsgSize)
+	end, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		return 0, "", false
+	}
+	buf = buf[:end]
+	_, off, err := dns.UnpackDomainName(buf, 0)
+	if err != nil {
+		return 0, "", false
+	}
+	// skip type, class, TTL and RDLENGTH
+	off += 10
+	if off+2 > len(buf) {
+		return 0, "", false
+	}
+	priority = binary.BigEndian.Uint16(buf[off:])
+	target, _, err = dns.UnpackDomainName(buf, off+2)
+	if err != nil {
+		return 0, "", false
+	}
+	return priority, target, true
+}
+
+// discardWriter drops the replies to queries sent by doh-client itself, while
+// keeping the addresses of the client they were sent on behalf of
+type discardWriter struct {
+	dns.ResponseWriter
+}
+
+func (w *discardWriter) WriteMsg(m *dns.Msg) error { return nil }
+
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+
+func (w *discardWriter) Close() error { return nil }
@@ -0,0 +1,126 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/m13253/dns-over-https/internal/ratelimit"
+	"github.com/m13253/dns-over-https/json-dns"
+)
+
+// clientPolicies maps the identities in verified client certificates to their
+// policies, as an alternative to token authentication for managed devices.
+type clientPolicies struct {
+	policies map[string]*clientIdentity
+	mu       sync.Mutex
+	buckets  map[string]*ratelimit.Bucket
+}
+
+func newClientPolicies(identities []clientIdentity) *clientPolicies {
+	cp := &clientPolicies{
+		policies: make(map[string]*clientIdentity, len(identities)),
+		buckets:  make(map[string]*ratelimit.Bucket),
+	}
+	for i := range identities {
+		cp.policies[identities[i].Identity] = &identities[i]
+	}
+	return cp
+}
+
+// certIdentities lists the names a certificate may be identified by, in the
+// order they are looked up.
+func certIdentities(cert *x509.Certificate) []string {
+	identities := make([]string, 0, 1+len(cert.DNSNames)+len(cert.EmailAddresses))
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	identities = append(identities, cert.DNSNames...)
+	return append(identities, cert.EmailAddresses...)
+}
+
+// lookup finds the policy of a verified certificate. The policy with identity
+// "*" applies to certificates without their own policy.
+func (cp *clientPolicies) lookup(cert *x509.Certificate) (identity string, policy *clientIdentity) {
+	identities := certIdentities(cert)
+	for _, identity := range identities {
+		if policy, ok := cp.policies[identity]; ok {
+			return identity, policy
+		}
+	}
+	if len(identities) != 0 {
+		identity = identities[0]
+	}
+	return identity, cp.policies["*"]
+}
+
+func (cp *clientPolicies) allow(identity string, policy *clientIdentity) bool {
+	if policy.QueriesPerSecond == 0 {
+		return true
+	}
+	cp.mu.Lock()
+	bucket, ok := cp.buckets[identity]
+	if !ok {
+		burst := policy.Burst
+		if burst == 0 {
+			burst = policy.QueriesPerSecond
+		}
+		bucket = ratelimit.NewBucket(float64(policy.QueriesPerSecond), float64(burst))
+		cp.buckets[identity] = bucket
+	}
+	cp.mu.Unlock()
+	return bucket.Allow()
+}
+
+// checkClientCert applies the policy of the client certificate, if any. It
+// returns false after writing an error response if the request is rejected.
+func (s *Server) checkClientCert(w http.ResponseWriter, r *http.Request, vh *vhost) bool {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return true
+	}
+	identity, policy := s.clientPolicies.lookup(r.TLS.VerifiedChains[0][0])
+	if policy == nil {
+		return true
+	}
+	if policy.Deny {
+		if vh.verbose {
+			log.Printf("Client certificate %q is denied\n", identity)
+		}
+		jsonDNS.FormatError(w, fmt.Sprintf("Client certificate %q is not allowed", identity), http.StatusForbidden)
+		return false
+	}
+	if !s.clientPolicies.allow(identity, policy) {
+		if vh.verbose {
+			log.Printf("Client certificate %q exceeded its quota\n", identity)
+		}
+		w.Header().Set("Retry-After", "1")
+		jsonDNS.FormatError(w, fmt.Sprintf("Quota exceeded for client certificate %q", identity), http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
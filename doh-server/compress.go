@@ -0,0 +1,116 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Responses smaller than this are never compressed, since the compression
+// overhead would outweigh the savings.
+const minCompressSize = 1024
+
+// negotiateEncoding picks gzip or deflate from the Accept-Encoding header, or
+// returns "" if neither is acceptable.
+func negotiateEncoding(acceptEncoding string) string {
+	gzipOK, deflateOK := false, false
+	for _, candidate := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(candidate, ";")
+		encoding := strings.ToLower(strings.TrimSpace(params[0]))
+		acceptable := true
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					acceptable = false
+				}
+			}
+		}
+		switch encoding {
+		case "gzip", "x-gzip":
+			gzipOK = acceptable
+		case "deflate":
+			deflateOK = acceptable
+		}
+	}
+	if gzipOK {
+		return "gzip"
+	}
+	if deflateOK {
+		return "deflate"
+	}
+	return ""
+}
+
+// writeCompressed writes the status code and a JSON response body, compressed
+// if enabled in the configuration and accepted by the client. A zero status
+// code means 200 OK.
+//
+// Binary application/dns-message responses are never compressed: they are
+// tiny already, and compressing them wastes CPU and leaks information about
+// the content through the compressed length.
+func (s *Server) writeCompressed(w http.ResponseWriter, r *http.Request, statusCode int, body []byte) {
+	writeBody := func(body []byte) {
+		if statusCode != 0 {
+			w.WriteHeader(statusCode)
+		}
+		w.Write(body)
+	}
+	if !s.conf.CompressJSON {
+		writeBody(body)
+		return
+	}
+	w.Header().Set("Vary", "Accept, Accept-Encoding")
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	if encoding == "" || len(body) < minCompressSize {
+		writeBody(body)
+		return
+	}
+
+	var buf bytes.Buffer
+	var cw io.WriteCloser
+	if encoding == "gzip" {
+		cw = gzip.NewWriter(&buf)
+	} else {
+		// HTTP "deflate" is actually the zlib format
+		cw = zlib.NewWriter(&buf)
+	}
+	if _, err := cw.Write(body); err != nil {
+		writeBody(body)
+		return
+	}
+	if err := cw.Close(); err != nil {
+		writeBody(body)
+		return
+	}
+	w.Header().Set("Content-Encoding", encoding)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	writeBody(buf.Bytes())
+}
@@ -25,36 +25,101 @@ package main
 
 import (
 	"fmt"
+	"net"
 
 	"github.com/BurntSushi/toml"
+	"github.com/m13253/dns-over-https/internal/confwatch"
 )
 
+type listenerConfig struct {
+	Addr       string `toml:"addr"`
+	Cert       string `toml:"cert"`
+	Key        string `toml:"key"`
+	ClientAuth string `toml:"client_auth"`
+	ClientCA   string `toml:"client_ca"`
+}
+
+type clientIdentity struct {
+	Identity         string `toml:"identity"`
+	Deny             bool   `toml:"deny"`
+	QueriesPerSecond uint   `toml:"queries_per_second"`
+	Burst            uint   `toml:"burst"`
+}
+
+type rewriteRule struct {
+	Upstream          string   `toml:"upstream"`
+	DropTypes         []string `toml:"drop_types"`
+	MinTTL            uint32   `toml:"min_ttl"`
+	MaxTTL            uint32   `toml:"max_ttl"`
+	ExtendedError     *uint16  `toml:"extended_error"`
+	ExtendedErrorText string   `toml:"extended_error_text"`
+
+	dropTypes map[uint16]bool
+}
+
+type virtualHostConfig struct {
+	Name         string        `toml:"name"`
+	Hostnames    []string      `toml:"hostnames"`
+	Upstream     []string      `toml:"upstream"`
+	Rewrites     []rewriteRule `toml:"rewrite"`
+	Verbose      *bool         `toml:"verbose"`
+	LogGuessedIP *bool         `toml:"log_guessed_client_ip"`
+}
+
 type config struct {
-	Listen           []string `toml:"listen"`
-	LocalAddr        string   `toml:"local_addr"`
-	Cert             string   `toml:"cert"`
-	Key              string   `toml:"key"`
-	Path             string   `toml:"path"`
-	Upstream         []string `toml:"upstream"`
-	Timeout          uint     `toml:"timeout"`
-	Tries            uint     `toml:"tries"`
-	TCPOnly          bool     `toml:"tcp_only"`
-	Verbose          bool     `toml:"verbose"`
-	DebugHTTPHeaders []string `toml:"debug_http_headers"`
-	LogGuessedIP     bool     `toml:"log_guessed_client_ip"`
+	Listen                 []string            `toml:"listen"`
+	Listeners              []listenerConfig    `toml:"listener"`
+	LocalAddr              string              `toml:"local_addr"`
+	Cert                   string              `toml:"cert"`
+	Key                    string              `toml:"key"`
+	ClientAuth             string              `toml:"client_auth"`
+	ClientCA               string              `toml:"client_ca"`
+	ClientIdentities       []clientIdentity    `toml:"client_identity"`
+	Rewrites               []rewriteRule       `toml:"rewrite"`
+	VirtualHosts           []virtualHostConfig `toml:"virtual_host"`
+	MetricsListen          string              `toml:"metrics_listen"`
+	Path                   string              `toml:"path"`
+	Upstream               []string            `toml:"upstream"`
+	Timeout                uint                `toml:"timeout"`
+	Tries                  uint                `toml:"tries"`
+	RequestTimeout         uint                `toml:"request_timeout"`
+	TCPOnly                bool                `toml:"tcp_only"`
+	BackendPoolSize        uint                `toml:"backend_pool_size"`
+	ADPolicy               string              `toml:"ad_policy"`
+	HonorCD                bool                `toml:"honor_cd"`
+	MinimalANY             bool                `toml:"minimal_any"`
+	ConfigReloadInterval   uint                `toml:"config_reload_interval"`
+	AuditLog               string              `toml:"audit_log"`
+	CompressJSON           bool                `toml:"compress_json"`
+	SyntheticAnswers       bool                `toml:"synthetic_answers"`
+	SyntheticAnswerCount   uint                `toml:"synthetic_answer_count"`
+	SyntheticTXTSize       uint                `toml:"synthetic_txt_size"`
+	SyntheticLatency       uint                `toml:"synthetic_latency"`
+	SyntheticLatencyJitter uint                `toml:"synthetic_latency_jitter"`
+	Verbose                bool                `toml:"verbose"`
+	DebugHTTPHeaders       []string            `toml:"debug_http_headers"`
+	LogGuessedIP           bool                `toml:"log_guessed_client_ip"`
 }
 
 func loadConfig(path string) (*config, error) {
-	conf := &config{}
-	metaData, err := toml.DecodeFile(path, conf)
+	conf := &config{
+		HonorCD: true,
+	}
+	files, err := confwatch.Files(path)
 	if err != nil {
 		return nil, err
 	}
-	for _, key := range metaData.Undecoded() {
-		return nil, &configError{fmt.Sprintf("unknown option %q", key.String())}
+	for _, file := range files {
+		metaData, err := toml.DecodeFile(file, conf)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range metaData.Undecoded() {
+			return nil, &configError{fmt.Sprintf("unknown option %q in %s", key.String(), file)}
+		}
 	}
 
-	if len(conf.Listen) == 0 {
+	if len(conf.Listen) == 0 && len(conf.Listeners) == 0 {
 		conf.Listen = []string{"127.0.0.1:8053", "[::1]:8053"}
 	}
 
@@ -70,14 +135,93 @@ func loadConfig(path string) (*config, error) {
 	if conf.Tries == 0 {
 		conf.Tries = 1
 	}
+	switch conf.ADPolicy {
+	case "":
+		conf.ADPolicy = "passthrough"
+	case "passthrough", "clear":
+	default:
+		return nil, &configError{fmt.Sprintf("unknown ad_policy %q", conf.ADPolicy)}
+	}
+	if conf.SyntheticAnswerCount == 0 {
+		conf.SyntheticAnswerCount = 1
+	}
+	if conf.SyntheticTXTSize == 0 {
+		conf.SyntheticTXTSize = 255
+	}
+	if conf.SyntheticTXTSize > 255 {
+		return nil, &configError{"synthetic_txt_size must be at most 255"}
+	}
+	if maxCount := maxSyntheticAnswerCount(conf.SyntheticTXTSize); conf.SyntheticAnswerCount > maxCount {
+		return nil, &configError{fmt.Sprintf("synthetic_answer_count must be at most %d with synthetic_txt_size = %d, or the answers don't fit in a DNS message", maxCount, conf.SyntheticTXTSize)}
+	}
+	if conf.RequestTimeout == 0 {
+		conf.RequestTimeout = conf.Timeout * conf.Tries
+	}
 
 	if (conf.Cert != "") != (conf.Key != "") {
 		return nil, &configError{"You must specify both -cert and -key to enable TLS"}
 	}
+	for _, listener := range conf.listeners() {
+		if err := listener.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for i := range conf.Rewrites {
+		if err := conf.Rewrites[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkUpstreams(conf.Upstream); err != nil {
+		return nil, err
+	}
+	hostnames := make(map[string]bool)
+	for i := range conf.VirtualHosts {
+		vc := &conf.VirtualHosts[i]
+		if len(vc.Hostnames) == 0 {
+			return nil, &configError{"virtual_host must have at least one hostname"}
+		}
+		if vc.Name == "" {
+			vc.Name = vc.Hostnames[0]
+		}
+		if vc.Name == "default" {
+			return nil, &configError{"virtual_host name \"default\" is reserved for the top-level configuration"}
+		}
+		for _, hostname := range vc.Hostnames {
+			hostname = normalizeHostname(hostname)
+			if hostnames[hostname] {
+				return nil, &configError{fmt.Sprintf("hostname %q is used by more than one virtual_host", hostname)}
+			}
+			hostnames[hostname] = true
+		}
+		// a virtual host without upstreams uses the top-level ones
+		if err := checkUpstreams(vc.Upstream); err != nil {
+			return nil, &configError{fmt.Sprintf("virtual_host %q: %s", vc.Name, err)}
+		}
+		for j := range vc.Rewrites {
+			if err := vc.Rewrites[j].compile(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, identity := range conf.ClientIdentities {
+		if identity.Identity == "" {
+			return nil, &configError{"client_identity must not be empty"}
+		}
+	}
 
 	return conf, nil
 }
 
+// checkUpstreams checks that every upstream is a host:port address
+func checkUpstreams(upstreams []string) error {
+	for _, upstream := range upstreams {
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			return &configError{fmt.Sprintf("invalid upstream %q: %s", upstream, err)}
+		}
+	}
+	return nil
+}
+
 type configError struct {
 	err string
 }
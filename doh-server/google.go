@@ -34,9 +34,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/m13253/dns-over-https/internal/dnsutil"
 	"github.com/m13253/dns-over-https/json-dns"
 	"github.com/miekg/dns"
-	"golang.org/x/net/idna"
 )
 
 func (s *Server) parseRequestGoogle(ctx context.Context, w http.ResponseWriter, r *http.Request) *DNSRequest {
@@ -47,7 +47,7 @@ func (s *Server) parseRequestGoogle(ctx context.Context, w http.ResponseWriter,
 			errtext: "Invalid argument value: \"name\"",
 		}
 	}
-	if punycode, err := idna.ToASCII(name); err == nil {
+	if punycode, err := dnsutil.ToASCIIName(name); err == nil {
 		name = punycode
 	} else {
 		return &DNSRequest{
@@ -83,7 +83,6 @@ func (s *Server) parseRequestGoogle(ctx context.Context, w http.ResponseWriter,
 	}
 
 	ednsClientSubnet := r.FormValue("edns_client_subnet")
-	ednsClientFamily := uint16(0)
 	ednsClientAddress := net.IP(nil)
 	ednsClientNetmask := uint8(255)
 	if ednsClientSubnet != "" {
@@ -99,14 +98,7 @@ func (s *Server) parseRequestGoogle(ctx context.Context, w http.ResponseWriter,
 					errtext: fmt.Sprintf("Invalid argument value: \"edns_client_subnet\" = %q", ednsClientSubnet),
 				}
 			}
-			if ipv4 := ednsClientAddress.To4(); ipv4 != nil {
-				ednsClientFamily = 1
-				ednsClientAddress = ipv4
-				ednsClientNetmask = 24
-			} else {
-				ednsClientFamily = 2
-				ednsClientNetmask = 56
-			}
+			ednsClientNetmask = dnsutil.DefaultClientNetmask(ednsClientAddress)
 		} else {
 			ednsClientAddress = net.ParseIP(ednsClientSubnet[:slash])
 			if ednsClientAddress == nil {
@@ -115,12 +107,6 @@ func (s *Server) parseRequestGoogle(ctx context.Context, w http.ResponseWriter,
 					errtext: fmt.Sprintf("Invalid argument value: \"edns_client_subnet\" = %q", ednsClientSubnet),
 				}
 			}
-			if ipv4 := ednsClientAddress.To4(); ipv4 != nil {
-				ednsClientFamily = 1
-				ednsClientAddress = ipv4
-			} else {
-				ednsClientFamily = 2
-			}
 			netmask, err := strconv.ParseUint(ednsClientSubnet[slash+1:], 10, 8)
 			if err != nil {
 				return &DNSRequest{
@@ -134,32 +120,17 @@ func (s *Server) parseRequestGoogle(ctx context.Context, w http.ResponseWriter,
 		ednsClientAddress = s.findClientIP(r)
 		if ednsClientAddress == nil {
 			ednsClientNetmask = 0
-		} else if ipv4 := ednsClientAddress.To4(); ipv4 != nil {
-			ednsClientFamily = 1
-			ednsClientAddress = ipv4
-			ednsClientNetmask = 24
 		} else {
-			ednsClientFamily = 2
-			ednsClientNetmask = 56
+			ednsClientNetmask = dnsutil.DefaultClientNetmask(ednsClientAddress)
 		}
 	}
 
 	msg := new(dns.Msg)
 	msg.SetQuestion(dns.Fqdn(name), rrType)
 	msg.CheckingDisabled = cd
-	opt := new(dns.OPT)
-	opt.Hdr.Name = "."
-	opt.Hdr.Rrtype = dns.TypeOPT
-	opt.SetUDPSize(dns.DefaultMsgSize)
-	opt.SetDo(true)
+	opt := dnsutil.NewOPT(dns.DefaultMsgSize, true)
 	if ednsClientAddress != nil {
-		edns0Subnet := new(dns.EDNS0_SUBNET)
-		edns0Subnet.Code = dns.EDNS0SUBNET
-		edns0Subnet.Family = ednsClientFamily
-		edns0Subnet.SourceNetmask = ednsClientNetmask
-		edns0Subnet.SourceScope = 0
-		edns0Subnet.Address = ednsClientAddress
-		opt.Option = append(opt.Option, edns0Subnet)
+		opt.Option = append(opt.Option, dnsutil.NewClientSubnet(ednsClientAddress, ednsClientNetmask, 0))
 	}
 	msg.Extra = append(msg.Extra, opt)
 
@@ -191,8 +162,9 @@ func (s *Server) generateResponseGoogle(ctx context.Context, w http.ResponseWrit
 		}
 		w.Header().Set("Expires", respJSON.EarliestExpires.Format(http.TimeFormat))
 	}
-	if respJSON.Status == dns.RcodeServerFailure {
-		w.WriteHeader(503)
+	statusCode := req.errcode
+	if statusCode == 0 && respJSON.Status == dns.RcodeServerFailure {
+		statusCode = 503
 	}
-	w.Write(respStr)
+	s.writeCompressed(w, r, statusCode, respStr)
 }
@@ -26,7 +26,6 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -36,13 +35,14 @@ import (
 	"strings"
 	"time"
 
+	"github.com/m13253/dns-over-https/internal/dnsutil"
 	"github.com/m13253/dns-over-https/json-dns"
 	"github.com/miekg/dns"
 )
 
-func (s *Server) parseRequestIETF(ctx context.Context, w http.ResponseWriter, r *http.Request) *DNSRequest {
+func (s *Server) parseRequestIETF(ctx context.Context, w http.ResponseWriter, r *http.Request, vh *vhost) *DNSRequest {
 	requestBase64 := r.FormValue("dns")
-	requestBinary, err := base64.RawURLEncoding.DecodeString(requestBase64)
+	requestBinary, err := dnsutil.DecodeBase64URL(requestBase64)
 	if err != nil {
 		return &DNSRequest{
 			errcode: 400,
@@ -80,7 +80,7 @@ func (s *Server) parseRequestIETF(ctx context.Context, w http.ResponseWriter, r
 		}
 	}
 
-	if s.conf.Verbose && len(msg.Question) > 0 {
+	if vh.verbose && len(msg.Question) > 0 {
 		question := &msg.Question[0]
 		questionName := question.Name
 		questionClass := ""
@@ -96,7 +96,7 @@ func (s *Server) parseRequestIETF(ctx context.Context, w http.ResponseWriter, r
 			questionType = strconv.FormatUint(uint64(question.Qtype), 10)
 		}
 		var clientip net.IP = nil
-		if s.conf.LogGuessedIP {
+		if vh.logGuessedIP {
 			clientip = s.findClientIP(r)
 		}
 		if clientip != nil {
@@ -108,43 +108,13 @@ func (s *Server) parseRequestIETF(ctx context.Context, w http.ResponseWriter, r
 
 	transactionID := msg.Id
 	msg.Id = dns.Id()
-	opt := msg.IsEdns0()
-	if opt == nil {
-		opt = new(dns.OPT)
-		opt.Hdr.Name = "."
-		opt.Hdr.Rrtype = dns.TypeOPT
-		opt.SetUDPSize(dns.DefaultMsgSize)
-		opt.SetDo(false)
-		msg.Extra = append([]dns.RR{opt}, msg.Extra...)
-	}
-	var edns0Subnet *dns.EDNS0_SUBNET
-	for _, option := range opt.Option {
-		if option.Option() == dns.EDNS0SUBNET {
-			edns0Subnet = option.(*dns.EDNS0_SUBNET)
-			break
-		}
-	}
+	opt := dnsutil.EnsureOPT(msg)
+	edns0Subnet := dnsutil.FindClientSubnet(opt)
 	isTailored := edns0Subnet == nil
 	if edns0Subnet == nil {
-		ednsClientFamily := uint16(0)
 		ednsClientAddress := s.findClientIP(r)
-		ednsClientNetmask := uint8(255)
 		if ednsClientAddress != nil {
-			if ipv4 := ednsClientAddress.To4(); ipv4 != nil {
-				ednsClientFamily = 1
-				ednsClientAddress = ipv4
-				ednsClientNetmask = 24
-			} else {
-				ednsClientFamily = 2
-				ednsClientNetmask = 56
-			}
-			edns0Subnet = new(dns.EDNS0_SUBNET)
-			edns0Subnet.Code = dns.EDNS0SUBNET
-			edns0Subnet.Family = ednsClientFamily
-			edns0Subnet.SourceNetmask = ednsClientNetmask
-			edns0Subnet.SourceScope = 0
-			edns0Subnet.Address = ednsClientAddress
-			opt.Option = append(opt.Option, edns0Subnet)
+			opt.Option = append(opt.Option, dnsutil.NewClientSubnet(ednsClientAddress, dnsutil.DefaultClientNetmask(ednsClientAddress), 0))
 		}
 	}
 
@@ -182,7 +152,9 @@ func (s *Server) generateResponseIETF(ctx context.Context, w http.ResponseWriter
 		w.Header().Set("Expires", respJSON.EarliestExpires.Format(http.TimeFormat))
 	}
 
-	if respJSON.Status == dns.RcodeServerFailure {
+	if req.errcode != 0 {
+		w.WriteHeader(req.errcode)
+	} else if respJSON.Status == dns.RcodeServerFailure {
 		w.WriteHeader(503)
 	}
 	w.Write(respBytes)
@@ -0,0 +1,108 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                   tls.NoClientCert,
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify_if_given":    tls.VerifyClientCertIfGiven,
+	"require_and_verify": tls.RequireAndVerifyClientCert,
+}
+
+// listeners returns all configured listeners, including the ones specified by
+// the top-level listen, cert, key, client_auth and client_ca options.
+func (conf *config) listeners() []listenerConfig {
+	listeners := make([]listenerConfig, 0, len(conf.Listen)+len(conf.Listeners))
+	for _, addr := range conf.Listen {
+		listeners = append(listeners, listenerConfig{
+			Addr:       addr,
+			Cert:       conf.Cert,
+			Key:        conf.Key,
+			ClientAuth: conf.ClientAuth,
+			ClientCA:   conf.ClientCA,
+		})
+	}
+	return append(listeners, conf.Listeners...)
+}
+
+func (l *listenerConfig) validate() error {
+	if l.Addr == "" {
+		return &configError{"listener address must not be empty"}
+	}
+	if (l.Cert != "") != (l.Key != "") {
+		return &configError{fmt.Sprintf("listener %s: you must specify both cert and key to enable TLS", l.Addr)}
+	}
+	clientAuth, ok := clientAuthTypes[l.ClientAuth]
+	if !ok {
+		return &configError{fmt.Sprintf("listener %s: unknown client_auth %q", l.Addr, l.ClientAuth)}
+	}
+	if clientAuth != tls.NoClientCert && l.Cert == "" {
+		return &configError{fmt.Sprintf("listener %s: client_auth requires TLS", l.Addr)}
+	}
+	if (clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert) && l.ClientCA == "" {
+		return &configError{fmt.Sprintf("listener %s: client_auth = %q requires client_ca", l.Addr, l.ClientAuth)}
+	}
+	return nil
+}
+
+// newHTTPServer creates an http.Server for the listener, with its own
+// certificate and client authentication policy.
+func (l *listenerConfig) newHTTPServer(handler http.Handler) (*http.Server, error) {
+	srv := &http.Server{
+		Addr:    l.Addr,
+		Handler: handler,
+	}
+	if l.Cert == "" {
+		return srv, nil
+	}
+	cert, err := tls.LoadX509KeyPair(l.Cert, l.Key)
+	if err != nil {
+		return nil, err
+	}
+	srv.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuthTypes[l.ClientAuth],
+	}
+	if l.ClientCA != "" {
+		caPEM, err := ioutil.ReadFile(l.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		srv.TLSConfig.ClientCAs = x509.NewCertPool()
+		if !srv.TLSConfig.ClientCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("listener %s: no certificate found in %s", l.Addr, l.ClientCA)
+		}
+	}
+	return srv, nil
+}
@@ -32,6 +32,10 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"time"
+
+	"github.com/m13253/dns-over-https/internal/audit"
+	"github.com/m13253/dns-over-https/internal/confwatch"
 )
 
 func checkPIDFile(pidFile string) (bool, error) {
@@ -46,6 +50,10 @@ retry:
 		if err != nil {
 			return false, err
 		}
+		if pid == uint64(os.Getpid()) {
+			// restarted in place after a configuration change
+			return true, nil
+		}
 		_, err = os.Stat(fmt.Sprintf("/proc/%d", pid))
 		if os.IsNotExist(err) {
 			err = os.Remove(pidFile)
@@ -110,9 +118,71 @@ func main() {
 		conf.Verbose = true
 	}
 
+	var auditLog *audit.Logger
+	if conf.AuditLog != "" {
+		auditLog, err = audit.Open(conf.AuditLog)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	files, _ := confwatch.Files(*confPath)
+	if err := auditLog.Log("start", audit.ProcessActor(), map[string]interface{}{
+		"version":  VERSION,
+		"files":    files,
+		"upstream": allUpstreams(conf),
+	}); err != nil {
+		log.Printf("Failed to write audit log: %v\n", err)
+	}
+
 	server, err := NewServer(conf)
 	if err != nil {
 		log.Fatalln(err)
 	}
+
+	if conf.ConfigReloadInterval != 0 {
+		go confwatch.Watch(*confPath, time.Duration(conf.ConfigReloadInterval)*time.Second, func(path string) error {
+			newConf, err := loadConfig(path)
+			auditReload(auditLog, path, conf, newConf, err, *verbose)
+			return err
+		})
+	}
 	_ = server.Start()
 }
+
+// auditReload records a changed configuration in the audit log, either
+// accepted or rejected, followed by one entry for each upstream added or
+// removed by it
+func auditReload(auditLog *audit.Logger, path string, conf, newConf *config, loadErr error, verbose bool) {
+	actor := "configuration at " + path
+	files, _ := confwatch.Files(path)
+	details := map[string]interface{}{
+		"files": files,
+	}
+	if loadErr != nil {
+		details["error"] = loadErr.Error()
+		if err := auditLog.Log("config_rejected", actor, details); err != nil {
+			log.Printf("Failed to write audit log: %v\n", err)
+		}
+		return
+	}
+
+	if verbose {
+		newConf.Verbose = true
+	}
+	details["changed"] = audit.ChangedKeys(conf, newConf)
+	if err := auditLog.Log("config_reload", actor, details); err != nil {
+		log.Printf("Failed to write audit log: %v\n", err)
+		return
+	}
+	oldUpstreams, newUpstreams := allUpstreams(conf), allUpstreams(newConf)
+	for _, upstream := range audit.Added(oldUpstreams, newUpstreams) {
+		if err := auditLog.Log("upstream_added", actor, map[string]interface{}{"upstream": upstream}); err != nil {
+			log.Printf("Failed to write audit log: %v\n", err)
+		}
+	}
+	for _, upstream := range audit.Added(newUpstreams, oldUpstreams) {
+		if err := auditLog.Log("upstream_removed", actor, map[string]interface{}{"upstream": upstream}); err != nil {
+			log.Printf("Failed to write audit log: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// connPool keeps persistent connections to each upstream DNS server, instead
+// of dialing a new socket per request, saving latency and ephemeral ports.
+// Each connection carries one query at a time. Reusing UDP sockets means
+// queries no longer get a random source port each, see backend_pool_size.
+type connPool struct {
+	network string
+	dialer  *net.Dialer
+	timeout time.Duration
+	conns   map[string]chan *dns.Conn
+}
+
+func newConnPool(network string, dialer *net.Dialer, timeout time.Duration, upstreams []string, size int) *connPool {
+	p := &connPool{
+		network: network,
+		dialer:  dialer,
+		timeout: timeout,
+		conns:   make(map[string]chan *dns.Conn, len(upstreams)),
+	}
+	for _, upstream := range upstreams {
+		p.conns[upstream] = make(chan *dns.Conn, size)
+	}
+	return p
+}
+
+// get returns an idle connection to upstream, or a new one if there is none,
+// reused tells which
+func (p *connPool) get(ctx context.Context, upstream string) (conn *dns.Conn, reused bool, err error) {
+	select {
+	case conn := <-p.conns[upstream]:
+		return conn, true, nil
+	default:
+	}
+	conn, err = p.dial(ctx, upstream)
+	return conn, false, err
+}
+
+func (p *connPool) dial(ctx context.Context, upstream string) (*dns.Conn, error) {
+	conn, err := p.dialer.DialContext(ctx, p.network, upstream)
+	if err != nil {
+		return nil, err
+	}
+	return &dns.Conn{Conn: conn, UDPSize: dns.DefaultMsgSize}, nil
+}
+
+func (p *connPool) put(upstream string, conn *dns.Conn) {
+	select {
+	case p.conns[upstream] <- conn:
+	default:
+		// the pool is full
+		conn.Close()
+	}
+}
+
+// exchange sends m to upstream and waits for the matching response. The
+// connection is only returned to the pool after a successful exchange.
+func (p *connPool) exchange(ctx context.Context, m *dns.Msg, upstream string) (*dns.Msg, error) {
+	conn, reused, err := p.get(ctx, upstream)
+	if err != nil {
+		return nil, err
+	}
+	r, err := p.exchangeOn(ctx, conn, m, upstream)
+	if err != nil && reused && ctx.Err() == nil && !isTimeout(err) {
+		// The upstream may have closed the connection while it was idle in
+		// the pool, which is only noticed when using it. Retry once on a new
+		// connection instead of failing the query.
+		conn, err = p.dial(ctx, upstream)
+		if err != nil {
+			return nil, err
+		}
+		r, err = p.exchangeOn(ctx, conn, m, upstream)
+	}
+	return r, err
+}
+
+func (p *connPool) exchangeOn(ctx context.Context, conn *dns.Conn, m *dns.Msg, upstream string) (*dns.Msg, error) {
+	deadline := time.Now().Add(p.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+	if err := conn.WriteMsg(m); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for {
+		r, err := conn.ReadMsg()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		// A reused UDP socket may still receive the late response of an
+		// earlier query which has timed out, skip it
+		if r.Id != m.Id || len(r.Question) != len(m.Question) || (len(r.Question) != 0 && !isSameQuestion(&r.Question[0], &m.Question[0])) {
+			if p.network == "udp" {
+				continue
+			}
+			conn.Close()
+			return nil, dns.ErrId
+		}
+		p.put(upstream, conn)
+		return r, nil
+	}
+}
+
+// isTimeout reports whether err is a timeout, after which there is no time
+// left to retry
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func isSameQuestion(a, b *dns.Question) bool {
+	return a.Qtype == b.Qtype && a.Qclass == b.Qclass && strings.EqualFold(a.Name, b.Name)
+}
@@ -0,0 +1,93 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/m13253/dns-over-https/internal/dnsutil"
+	"github.com/miekg/dns"
+)
+
+func (rule *rewriteRule) compile() error {
+	if rule.MaxTTL != 0 && rule.MinTTL > rule.MaxTTL {
+		return &configError{"rewrite: min_ttl must not be larger than max_ttl"}
+	}
+	rule.dropTypes = make(map[uint16]bool, len(rule.DropTypes))
+	for _, name := range rule.DropTypes {
+		rrType, ok := dns.StringToType[strings.ToUpper(name)]
+		if !ok {
+			return &configError{fmt.Sprintf("rewrite: unknown record type %q in drop_types", name)}
+		}
+		if rrType == dns.TypeOPT {
+			return &configError{"rewrite: OPT records can't be dropped"}
+		}
+		rule.dropTypes[rrType] = true
+	}
+	return nil
+}
+
+// rewriteResponse applies the [[rewrite]] rules of the virtual host to a
+// response from the backend, before it is written to the client. Rules are applied in order,
+// each one only to responses from its upstream, or all responses if the
+// upstream is empty.
+func (s *Server) rewriteResponse(req *DNSRequest) {
+	for i := range req.vhost.rewrites {
+		rule := &req.vhost.rewrites[i]
+		if rule.Upstream != "" && rule.Upstream != req.currentUpstream {
+			continue
+		}
+		msg := req.response
+		msg.Answer = rule.rewriteRecords(msg.Answer)
+		msg.Ns = rule.rewriteRecords(msg.Ns)
+		msg.Extra = rule.rewriteRecords(msg.Extra)
+		if rule.ExtendedError != nil {
+			dnsutil.SetExtendedError(msg, *rule.ExtendedError, rule.ExtendedErrorText)
+		}
+	}
+}
+
+// rewriteRecords drops and clamps the TTL of records in place
+func (rule *rewriteRule) rewriteRecords(records []dns.RR) []dns.RR {
+	kept := records[:0]
+	for _, rr := range records {
+		header := rr.Header()
+		if header.Rrtype == dns.TypeOPT {
+			kept = append(kept, rr)
+			continue
+		}
+		if rule.dropTypes[header.Rrtype] {
+			continue
+		}
+		if header.Ttl < rule.MinTTL {
+			header.Ttl = rule.MinTTL
+		}
+		if rule.MaxTTL != 0 && header.Ttl > rule.MaxTTL {
+			header.Ttl = rule.MaxTTL
+		}
+		kept = append(kept, rr)
+	}
+	return kept
+}
@@ -26,24 +26,35 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/handlers"
+	"github.com/m13253/dns-over-https/internal/dnsutil"
 	"github.com/m13253/dns-over-https/json-dns"
+	"github.com/m13253/dns-over-https/metrics"
 	"github.com/miekg/dns"
 )
 
 type Server struct {
-	conf      *config
-	udpClient *dns.Client
-	tcpClient *dns.Client
-	servemux  *http.ServeMux
+	conf           *config
+	udpClient      *dns.Client
+	tcpClient      *dns.Client
+	servemux       *http.ServeMux
+	clientPolicies *clientPolicies
+	udpPool        *connPool
+	tcpPool        *connPool
+	ready          int32
+	defaultHost    *vhost
+	vhosts         map[string]*vhost
+	syntheticTXT   string
 }
 
 type DNSRequest struct {
@@ -51,6 +62,7 @@ type DNSRequest struct {
 	response        *dns.Msg
 	transactionID   uint16
 	currentUpstream string
+	vhost           *vhost
 	isTailored      bool
 	errcode         int
 	errtext         string
@@ -69,7 +81,12 @@ func NewServer(conf *config) (*Server, error) {
 			Net:     "tcp",
 			Timeout: timeout,
 		},
-		servemux: http.NewServeMux(),
+		servemux:       http.NewServeMux(),
+		clientPolicies: newClientPolicies(conf.ClientIdentities),
+	}
+	s.defaultHost, s.vhosts = newVirtualHosts(conf)
+	if conf.SyntheticAnswers {
+		s.syntheticTXT = strings.Repeat("x", int(conf.SyntheticTXTSize))
 	}
 	if conf.LocalAddr != "" {
 		udpLocalAddr, err := net.ResolveUDPAddr("udp", conf.LocalAddr)
@@ -89,30 +106,76 @@ func NewServer(conf *config) (*Server, error) {
 			LocalAddr: tcpLocalAddr,
 		}
 	}
+	if conf.BackendPoolSize != 0 {
+		udpDialer, tcpDialer := s.udpClient.Dialer, s.tcpClient.Dialer
+		if udpDialer == nil {
+			udpDialer = &net.Dialer{Timeout: timeout}
+		}
+		if tcpDialer == nil {
+			tcpDialer = &net.Dialer{Timeout: timeout}
+		}
+		upstreams := allUpstreams(conf)
+		s.udpPool = newConnPool("udp", udpDialer, timeout, upstreams, int(conf.BackendPoolSize))
+		s.tcpPool = newConnPool("tcp", tcpDialer, timeout, upstreams, int(conf.BackendPoolSize))
+	}
 	s.servemux.HandleFunc(conf.Path, s.handlerFunc)
+	if conf.Path != "/ready" {
+		s.servemux.HandleFunc("/ready", s.readyHandler)
+	}
 	return s, nil
 }
 
 func (s *Server) Start() error {
-	servemux := http.Handler(s.servemux)
-	if s.conf.Verbose {
-		servemux = handlers.CombinedLoggingHandler(os.Stdout, servemux)
+	// log requests if their virtual host is verbose
+	loggedServemux := handlers.CombinedLoggingHandler(os.Stdout, s.servemux)
+	servemux := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.virtualHostFor(r).verbose {
+			loggedServemux.ServeHTTP(w, r)
+		} else {
+			s.servemux.ServeHTTP(w, r)
+		}
+	}))
+	listeners := s.conf.listeners()
+	numListeners := len(listeners)
+	if s.conf.MetricsListen != "" {
+		numListeners++
+	}
+	results := make(chan error, numListeners)
+	if s.conf.MetricsListen != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics.Handler())
+			err := http.ListenAndServe(s.conf.MetricsListen, mux)
+			if err != nil {
+				log.Println(err)
+			}
+			results <- err
+		}()
 	}
-	results := make(chan error, len(s.conf.Listen))
-	for _, addr := range s.conf.Listen {
-		go func(addr string) {
+	for _, listener := range listeners {
+		srv, err := listener.newHTTPServer(servemux)
+		if err != nil {
+			return err
+		}
+		ln, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		go func(srv *http.Server, ln net.Listener) {
 			var err error
-			if s.conf.Cert != "" || s.conf.Key != "" {
-				err = http.ListenAndServeTLS(addr, s.conf.Cert, s.conf.Key, servemux)
+			if srv.TLSConfig != nil {
+				err = srv.ServeTLS(ln, "", "")
 			} else {
-				err = http.ListenAndServe(addr, servemux)
+				err = srv.Serve(ln)
 			}
 			if err != nil {
 				log.Println(err)
 			}
 			results <- err
-		}(addr)
+		}(srv, ln)
 	}
+	atomic.StoreInt32(&s.ready, 1)
 	// wait for all handlers
 	for i := 0; i < cap(results); i++ {
 		err := <-results
@@ -124,8 +187,18 @@ func (s *Server) Start() error {
 	return nil
 }
 
+// readyHandler answers 200 once all listeners are open, for readiness probes
+func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.ready) == 0 {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ready\n")
+}
+
 func (s *Server) handlerFunc(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(s.conf.RequestTimeout)*time.Second)
+	defer cancel()
 
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS, POST")
@@ -139,6 +212,11 @@ func (s *Server) handlerFunc(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	vh := s.virtualHostFor(r)
+	if !s.checkClientCert(w, r, vh) {
+		return
+	}
+
 	if r.Form == nil {
 		const maxMemory = 32 << 20 // 32 MB
 		r.ParseMultipartForm(maxMemory)
@@ -191,9 +269,9 @@ func (s *Server) handlerFunc(w http.ResponseWriter, r *http.Request) {
 	if contentType == "application/dns-json" {
 		req = s.parseRequestGoogle(ctx, w, r)
 	} else if contentType == "application/dns-message" {
-		req = s.parseRequestIETF(ctx, w, r)
+		req = s.parseRequestIETF(ctx, w, r, vh)
 	} else if contentType == "application/dns-udpwireformat" {
-		req = s.parseRequestIETF(ctx, w, r)
+		req = s.parseRequestIETF(ctx, w, r, vh)
 	} else {
 		jsonDNS.FormatError(w, fmt.Sprintf("Invalid argument value: \"ct\" = %q", contentType), 415)
 		return
@@ -206,15 +284,45 @@ func (s *Server) handlerFunc(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	req.vhost = vh
 	req = s.patchRootRD(req)
+	if !s.conf.HonorCD {
+		req.request.CheckingDisabled = false
+	}
 
 	var err error
-	req, err = s.doDNSQuery(ctx, req)
+	if s.conf.MinimalANY && dnsutil.IsMinimalANYQuery(req.request) {
+		// RFC 8482: ANY is mostly used for amplification, answer locally
+		req.response = jsonDNS.PrepareReply(req.request)
+		req.response.Rcode = dns.RcodeSuccess
+		req.response.Answer = []dns.RR{dnsutil.MinimalANYAnswer(req.request.Question[0].Name)}
+	} else if s.conf.SyntheticAnswers {
+		req, err = s.syntheticQuery(ctx, req)
+	} else {
+		req, err = s.doDNSQuery(ctx, req)
+	}
 	if err != nil {
-		jsonDNS.FormatError(w, fmt.Sprintf("DNS query failure (%s)", err.Error()), 503)
-		return
+		// Answer SERVFAIL in the requested format with an Extended DNS Error,
+		// so the client can tell the reason apart from a malformed request
+		req.response = jsonDNS.PrepareReply(req.request)
+		req.response.Rcode = dns.RcodeServerFailure
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Printf("DNS query timed out after %d seconds\n", s.conf.RequestTimeout)
+			dnsutil.SetExtendedError(req.response, dnsutil.ExtendedErrorNoReachableAuthority, "upstream timed out")
+			req.errcode = http.StatusGatewayTimeout
+		} else {
+			dnsutil.SetExtendedError(req.response, dnsutil.ExtendedErrorNetworkError, fmt.Sprintf("DNS query failure (%s)", err.Error()))
+			req.errcode = http.StatusServiceUnavailable
+		}
+	} else {
+		s.rewriteResponse(req)
+		if s.conf.ADPolicy == "clear" {
+			req.response.AuthenticatedData = false
+		}
 	}
 
+	countQuery(req.vhost, req, err != nil)
+
 	if responseType == "application/json" {
 		s.generateResponseGoogle(ctx, w, r, req)
 	} else if responseType == "application/dns-message" {
@@ -265,22 +373,62 @@ func (s *Server) patchRootRD(req *DNSRequest) *DNSRequest {
 
 func (s *Server) doDNSQuery(ctx context.Context, req *DNSRequest) (resp *DNSRequest, err error) {
 	// TODO(m13253): Make ctx work. Waiting for a patch for ExchangeContext from miekg/dns.
-	numServers := len(s.conf.Upstream)
+	upstreams := req.vhost.upstream
 	for i := uint(0); i < s.conf.Tries; i++ {
-		req.currentUpstream = s.conf.Upstream[rand.Intn(numServers)]
+		req.currentUpstream = upstreams[rand.Intn(len(upstreams))]
 		if !s.conf.TCPOnly {
-			req.response, _, err = s.udpClient.Exchange(req.request, req.currentUpstream)
+			req.response, err = s.exchange(ctx, s.udpClient, s.udpPool, req)
 			if err == nil && req.response != nil && req.response.Truncated {
 				log.Println(err)
-				req.response, _, err = s.tcpClient.Exchange(req.request, req.currentUpstream)
+				req.response, err = s.exchange(ctx, s.tcpClient, s.tcpPool, req)
 			}
 		} else {
-			req.response, _, err = s.tcpClient.Exchange(req.request, req.currentUpstream)
+			req.response, err = s.exchange(ctx, s.tcpClient, s.tcpPool, req)
 		}
 		if err == nil {
 			return req, nil
 		}
 		log.Printf("DNS error from upstream %s: %s\n", req.currentUpstream, err.Error())
+		if ctx.Err() != nil {
+			// the deadline of the whole request is exceeded, no need to retry
+			break
+		}
 	}
 	return req, err
 }
+
+// exchange queries the current upstream through the connection pool if it is
+// enabled, or a new connection otherwise
+func (s *Server) exchange(ctx context.Context, client *dns.Client, pool *connPool, req *DNSRequest) (*dns.Msg, error) {
+	if pool != nil {
+		return pool.exchange(ctx, req.request, req.currentUpstream)
+	}
+	// ExchangeContext of miekg/dns only applies the deadline to dialing and
+	// does so by replacing the Dialer of the client, which is shared by all
+	// requests and may carry local_addr. Use a client for this request only,
+	// with the deadline as its timeout, so that only an early cancel of ctx
+	// is not noticed.
+	timeout := client.Timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		untilDeadline := time.Until(deadline)
+		if untilDeadline <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		if untilDeadline < timeout {
+			timeout = untilDeadline
+		}
+	}
+	dialer := net.Dialer{}
+	if client.Dialer != nil {
+		dialer = *client.Dialer
+	}
+	dialer.Timeout = timeout
+	requestClient := &dns.Client{
+		Net:     client.Net,
+		UDPSize: client.UDPSize,
+		Timeout: timeout,
+		Dialer:  &dialer,
+	}
+	response, _, err := requestClient.Exchange(req.request, req.currentUpstream)
+	return response, err
+}
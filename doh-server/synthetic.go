@@ -0,0 +1,104 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/m13253/dns-over-https/json-dns"
+	"github.com/miekg/dns"
+)
+
+// syntheticTTL is the TTL of synthetic answers
+const syntheticTTL = 300
+
+// syntheticReserved is the space of a synthetic answer kept for the header,
+// the question and the OPT record
+const syntheticReserved = 512
+
+// maxSyntheticAnswerCount returns the largest synthetic_answer_count for which
+// every answer fits in a DNS message. Each record takes a compressed name and
+// the fixed fields, plus 16 bytes of AAAA data or a TXT string of txtSize
+// bytes, whichever is larger. The limit stays far below the 65536 distinct
+// addresses available.
+func maxSyntheticAnswerCount(txtSize uint) uint {
+	rdata := uint(net.IPv6len)
+	if txtSize+1 > rdata {
+		rdata = txtSize + 1
+	}
+	return (dns.MaxMsgSize - syntheticReserved) / (2 + 10 + rdata)
+}
+
+// syntheticQuery answers a query from memory instead of asking the backend,
+// so doh-server can be used as a benchmark target for DoH clients and proxies.
+// Addresses come from the benchmarking ranges 198.18.0.0/15 (RFC 2544) and
+// 2001:2::/48 (RFC 5180).
+func (s *Server) syntheticQuery(ctx context.Context, req *DNSRequest) (*DNSRequest, error) {
+	latency := time.Duration(s.conf.SyntheticLatency) * time.Millisecond
+	if s.conf.SyntheticLatencyJitter != 0 {
+		latency += time.Duration(rand.Int63n(int64(s.conf.SyntheticLatencyJitter)+1)) * time.Millisecond
+	}
+	if latency != 0 {
+		timer := time.NewTimer(latency)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return req, ctx.Err()
+		}
+	}
+
+	req.currentUpstream = "synthetic"
+	req.response = jsonDNS.PrepareReply(req.request)
+	req.response.Rcode = dns.RcodeSuccess
+	req.response.RecursionAvailable = true
+	question := req.request.Question[0]
+	header := dns.RR_Header{
+		Name:   question.Name,
+		Rrtype: question.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    syntheticTTL,
+	}
+	for i := 0; i < int(s.conf.SyntheticAnswerCount); i++ {
+		var rr dns.RR
+		switch question.Qtype {
+		case dns.TypeA:
+			rr = &dns.A{Hdr: header, A: net.IPv4(198, 18, byte(i>>8), byte(i))}
+		case dns.TypeAAAA:
+			ip := net.ParseIP("2001:2::")
+			ip[14], ip[15] = byte(i>>8), byte(i)
+			rr = &dns.AAAA{Hdr: header, AAAA: ip}
+		case dns.TypeTXT:
+			rr = &dns.TXT{Hdr: header, Txt: []string{s.syntheticTXT}}
+		default:
+			// NODATA for everything else
+			return req, nil
+		}
+		req.response.Answer = append(req.response.Answer, rr)
+	}
+	return req, nil
+}
@@ -0,0 +1,148 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/m13253/dns-over-https/metrics"
+	"github.com/miekg/dns"
+)
+
+var (
+	serverQueries = metrics.NewCounter(
+		"doh_server_queries_total",
+		"Number of answered queries, by virtual host and response code.",
+		"vhost", "rcode",
+	)
+	serverUpstreamErrors = metrics.NewCounter(
+		"doh_server_upstream_errors_total",
+		"Number of queries which failed because the backend didn't answer, by virtual host.",
+		"vhost",
+	)
+)
+
+// vhost is the configuration a request is served with, selected by the
+// hostname the client connected to. The top-level configuration is the
+// virtual host named "default", used when no [[virtual_host]] matches.
+type vhost struct {
+	name         string
+	upstream     []string
+	rewrites     []rewriteRule
+	verbose      bool
+	logGuessedIP bool
+}
+
+// newVirtualHosts returns the default virtual host, and the configured ones
+// by hostname. Options left out of a [[virtual_host]] are inherited from the
+// top level, except rewrite rules. conf must have been checked by loadConfig.
+func newVirtualHosts(conf *config) (defaultHost *vhost, hosts map[string]*vhost) {
+	defaultHost = &vhost{
+		name:         "default",
+		upstream:     conf.Upstream,
+		rewrites:     conf.Rewrites,
+		verbose:      conf.Verbose,
+		logGuessedIP: conf.LogGuessedIP,
+	}
+	hosts = make(map[string]*vhost)
+	for _, vc := range conf.VirtualHosts {
+		vh := &vhost{
+			name:         vc.Name,
+			upstream:     vc.Upstream,
+			rewrites:     vc.Rewrites,
+			verbose:      conf.Verbose,
+			logGuessedIP: conf.LogGuessedIP,
+		}
+		if len(vh.upstream) == 0 {
+			vh.upstream = conf.Upstream
+		}
+		if vc.Verbose != nil {
+			vh.verbose = *vc.Verbose
+		}
+		if vc.LogGuessedIP != nil {
+			vh.logGuessedIP = *vc.LogGuessedIP
+		}
+		for _, hostname := range vc.Hostnames {
+			hosts[normalizeHostname(hostname)] = vh
+		}
+	}
+	return defaultHost, hosts
+}
+
+// allUpstreams lists the upstreams of every virtual host, for the connection pools
+func allUpstreams(conf *config) []string {
+	seen := make(map[string]bool)
+	var upstreams []string
+	add := func(list []string) {
+		for _, upstream := range list {
+			if !seen[upstream] {
+				seen[upstream] = true
+				upstreams = append(upstreams, upstream)
+			}
+		}
+	}
+	add(conf.Upstream)
+	for _, vc := range conf.VirtualHosts {
+		add(vc.Upstream)
+	}
+	return upstreams
+}
+
+func normalizeHostname(hostname string) string {
+	return strings.TrimSuffix(strings.ToLower(hostname), ".")
+}
+
+// virtualHostFor selects the virtual host of a request by the TLS SNI, or
+// the Host header for plain HTTP, e.g. behind a reverse proxy
+func (s *Server) virtualHostFor(r *http.Request) *vhost {
+	if len(s.vhosts) == 0 {
+		return s.defaultHost
+	}
+	hostname := ""
+	if r.TLS != nil && r.TLS.ServerName != "" {
+		hostname = r.TLS.ServerName
+	} else if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		hostname = host
+	} else {
+		hostname = r.Host
+	}
+	if vh, ok := s.vhosts[normalizeHostname(hostname)]; ok {
+		return vh
+	}
+	return s.defaultHost
+}
+
+// countQuery updates the metrics of the virtual host with an answered query
+func countQuery(vh *vhost, req *DNSRequest, upstreamFailed bool) {
+	if upstreamFailed {
+		serverUpstreamErrors.Inc(vh.name)
+	}
+	rcode, ok := dns.RcodeToString[req.response.Rcode]
+	if !ok {
+		rcode = "other"
+	}
+	serverQueries.Inc(vh.name, rcode)
+}
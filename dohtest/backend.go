@@ -0,0 +1,141 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/m13253/dns-over-https/internal/dnsutil"
+	"github.com/miekg/dns"
+)
+
+// backend is a fake recursive resolver for doh-server, it answers names in
+// the "test." zone according to what each test case needs
+type backend struct {
+	udp *dns.Server
+	tcp *dns.Server
+}
+
+func startBackend(addr string) (*backend, error) {
+	udpConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tcpListener, err := net.Listen("tcp", addr)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	b := &backend{
+		udp: &dns.Server{PacketConn: udpConn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) { serveBackend(w, r, false) })},
+		tcp: &dns.Server{Listener: tcpListener, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) { serveBackend(w, r, true) })},
+	}
+	go b.udp.ActivateAndServe()
+	go b.tcp.ActivateAndServe()
+	return b, nil
+}
+
+func (b *backend) shutdown() {
+	b.udp.Shutdown()
+	b.tcp.Shutdown()
+}
+
+func serveBackend(w dns.ResponseWriter, r *dns.Msg, isTCP bool) {
+	if len(r.Question) != 1 {
+		return
+	}
+	question := r.Question[0]
+	reply := new(dns.Msg)
+	reply.SetReply(r)
+	reply.RecursionAvailable = true
+	opt := r.IsEdns0()
+	if opt != nil {
+		reply.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+
+	switch strings.ToLower(question.Name) {
+	case "a.test.":
+		reply.Answer = append(reply.Answer, newRR("a.test. 300 IN A 192.0.2.1"))
+
+	case "many.test.":
+		// 40 records don't fit in a 512 byte UDP response
+		for i := 1; i <= 40; i++ {
+			reply.Answer = append(reply.Answer, newRR("many.test. 300 IN A 192.0.2."+strconv.Itoa(i)))
+		}
+
+	case "large.test.":
+		// larger than the 4096 byte EDNS buffer doh-server asks for
+		txt := strings.Repeat("x", 250)
+		for i := 0; i < 20; i++ {
+			reply.Answer = append(reply.Answer, newRR("large.test. 300 IN TXT \""+txt+strconv.Itoa(i)+"\""))
+		}
+
+	case "dnssec.test.":
+		reply.Answer = append(reply.Answer, newRR("dnssec.test. 300 IN A 192.0.2.2"))
+		if opt != nil && opt.Do() {
+			reply.Answer = append(reply.Answer, newRR("dnssec.test. 300 IN RRSIG A 13 2 300 20300101000000 20200101000000 12345 test. dGVzdA=="))
+			reply.AuthenticatedData = true
+		}
+
+	case "ecs.test.":
+		// echo the client subnet doh-server forwarded
+		subnet := "none"
+		if ecs := dnsutil.FindClientSubnet(opt); ecs != nil {
+			subnet = ecs.Address.String() + "/" + strconv.Itoa(int(ecs.SourceNetmask))
+		}
+		reply.Answer = append(reply.Answer, newRR("ecs.test. 0 IN TXT \""+subnet+"\""))
+
+	case "timeout.test.":
+		// never answer
+		return
+
+	default:
+		reply.Rcode = dns.RcodeNameError
+	}
+
+	if !isTCP {
+		size := dns.MinMsgSize
+		if opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		if reply.Len() > size {
+			reply.Answer = nil
+			reply.Truncated = true
+		}
+	}
+	if err := w.WriteMsg(reply); err != nil {
+		log.Println(err)
+	}
+}
+
+func newRR(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
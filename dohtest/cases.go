@@ -0,0 +1,202 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/m13253/dns-over-https/internal/dnsutil"
+	"github.com/miekg/dns"
+)
+
+type testCase struct {
+	name string
+	run  func(clientAddr string) error
+}
+
+var testCases = []testCase{
+	{"basic", testBasic},
+	{"tcp", testTCP},
+	{"truncation", testTruncation},
+	{"dnssec", testDNSSEC},
+	{"large_txt", testLargeTXT},
+	{"ecs", testECS},
+	{"nxdomain", testNXDomain},
+	{"timeout", testTimeout},
+}
+
+func newQuery(name string, qtype uint16) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	return msg
+}
+
+func exchange(network string, msg *dns.Msg, clientAddr string, timeout time.Duration) (*dns.Msg, error) {
+	client := &dns.Client{Net: network, Timeout: timeout}
+	reply, _, err := client.Exchange(msg, clientAddr)
+	return reply, err
+}
+
+func expectRcode(reply *dns.Msg, rcode int) error {
+	if reply.Rcode != rcode {
+		return fmt.Errorf("rcode is %s, expected %s", dns.RcodeToString[reply.Rcode], dns.RcodeToString[rcode])
+	}
+	return nil
+}
+
+func expectA(reply *dns.Msg, ip string) error {
+	if err := expectRcode(reply, dns.RcodeSuccess); err != nil {
+		return err
+	}
+	for _, rr := range reply.Answer {
+		if a, ok := rr.(*dns.A); ok && a.A.Equal(net.ParseIP(ip)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("answer has no A record %s", ip)
+}
+
+func testBasic(clientAddr string) error {
+	reply, err := exchange("udp", newQuery("a.test.", dns.TypeA), clientAddr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	return expectA(reply, "192.0.2.1")
+}
+
+func testTCP(clientAddr string) error {
+	reply, err := exchange("tcp", newQuery("a.test.", dns.TypeA), clientAddr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	return expectA(reply, "192.0.2.1")
+}
+
+// testTruncation checks that an answer too large for a 512 byte UDP response
+// is truncated, and complete over TCP
+func testTruncation(clientAddr string) error {
+	reply, err := exchange("udp", newQuery("many.test.", dns.TypeA), clientAddr, 5*time.Second)
+	if reply == nil {
+		return err
+	}
+	if !reply.Truncated {
+		return errors.New("UDP response is not truncated")
+	}
+	reply, err = exchange("tcp", newQuery("many.test.", dns.TypeA), clientAddr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if len(reply.Answer) != 40 {
+		return fmt.Errorf("TCP response has %d records, expected 40", len(reply.Answer))
+	}
+	return nil
+}
+
+// testDNSSEC checks that the DO bit reaches the backend, and signatures and
+// the AD bit make it back
+func testDNSSEC(clientAddr string) error {
+	query := newQuery("dnssec.test.", dns.TypeA)
+	query.SetEdns0(4096, true)
+	reply, err := exchange("udp", query, clientAddr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if err := expectA(reply, "192.0.2.2"); err != nil {
+		return err
+	}
+	hasRRSIG := false
+	for _, rr := range reply.Answer {
+		if _, ok := rr.(*dns.RRSIG); ok {
+			hasRRSIG = true
+		}
+	}
+	if !hasRRSIG {
+		return errors.New("answer has no RRSIG record")
+	}
+	if !reply.AuthenticatedData {
+		return errors.New("AD bit is not set")
+	}
+	return nil
+}
+
+// testLargeTXT checks an answer which only fits in TCP, both between
+// doh-server and the backend, and between doh-client and us
+func testLargeTXT(clientAddr string) error {
+	reply, err := exchange("tcp", newQuery("large.test.", dns.TypeTXT), clientAddr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if err := expectRcode(reply, dns.RcodeSuccess); err != nil {
+		return err
+	}
+	if len(reply.Answer) != 20 {
+		return fmt.Errorf("answer has %d records, expected 20", len(reply.Answer))
+	}
+	return nil
+}
+
+// testECS checks that a client subnet sent by the client is forwarded as is
+func testECS(clientAddr string) error {
+	query := newQuery("ecs.test.", dns.TypeTXT)
+	opt := dnsutil.NewOPT(4096, false)
+	opt.Option = append(opt.Option, dnsutil.NewClientSubnet(net.ParseIP("203.0.113.0"), 24, 0))
+	query.Extra = append(query.Extra, opt)
+	reply, err := exchange("udp", query, clientAddr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if err := expectRcode(reply, dns.RcodeSuccess); err != nil {
+		return err
+	}
+	for _, rr := range reply.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && len(txt.Txt) == 1 {
+			if txt.Txt[0] != "203.0.113.0/24" {
+				return fmt.Errorf("backend received client subnet %s, expected 203.0.113.0/24", txt.Txt[0])
+			}
+			return nil
+		}
+	}
+	return errors.New("answer has no TXT record")
+}
+
+func testNXDomain(clientAddr string) error {
+	reply, err := exchange("udp", newQuery("nonexistent.test.", dns.TypeA), clientAddr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	return expectRcode(reply, dns.RcodeNameError)
+}
+
+// testTimeout checks that a backend which never answers results in SERVFAIL,
+// instead of no response at all
+func testTimeout(clientAddr string) error {
+	reply, err := exchange("udp", newQuery("timeout.test.", dns.TypeA), clientAddr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	return expectRcode(reply, dns.RcodeServerFailure)
+}
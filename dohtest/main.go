@@ -0,0 +1,193 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const serverConfTemplate = `listen = ["%s"]
+upstream = ["%s"]
+timeout = 2
+tries = 1
+`
+
+const clientConfTemplate = `listen = ["%s"]
+
+[upstream]
+upstream_selector = "random"
+
+[[upstream.upstream_ietf]]
+    url = "http://%s/dns-query"
+    weight = 50
+
+[others]
+timeout = 5
+`
+
+func main() {
+	serverPath := flag.String("server", "doh-server", "Path of the doh-server binary")
+	clientPath := flag.String("client", "doh-client", "Path of the doh-client binary")
+	verbose := flag.Bool("verbose", false, "Show the output of doh-server and doh-client")
+	flag.Parse()
+
+	os.Exit(run(*serverPath, *clientPath, *verbose))
+}
+
+func run(serverPath, clientPath string, verbose bool) int {
+	dir, err := ioutil.TempDir("", "dohtest")
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	defer os.RemoveAll(dir)
+
+	backendAddr, serverAddr, clientAddr, err := freeAddrs()
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	b, err := startBackend(backendAddr)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	defer b.shutdown()
+
+	var output io.Writer = ioutil.Discard
+	if verbose {
+		output = os.Stderr
+	}
+	server, err := startProcess(dir, serverPath, "doh-server.conf", fmt.Sprintf(serverConfTemplate, serverAddr, backendAddr), verbose, output)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	defer stopProcess(server)
+	client, err := startProcess(dir, clientPath, "doh-client.conf", fmt.Sprintf(clientConfTemplate, clientAddr, serverAddr), verbose, output)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	defer stopProcess(client)
+
+	if err := waitReady(clientAddr, 10*time.Second); err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	failed := 0
+	for _, tc := range testCases {
+		start := time.Now()
+		err := tc.run(clientAddr)
+		elapsed := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL  %-12s %v (%s)\n", tc.name, err, elapsed)
+		} else {
+			fmt.Printf("PASS  %-12s (%s)\n", tc.name, elapsed)
+		}
+	}
+	fmt.Printf("%d passed, %d failed\n", len(testCases)-failed, failed)
+	if failed != 0 {
+		return 1
+	}
+	return 0
+}
+
+// freeAddrs picks three unused ports on the loopback interface, for the fake
+// backend, doh-server and doh-client. The backend and doh-client need the
+// port for both UDP and TCP.
+func freeAddrs() (backendAddr, serverAddr, clientAddr string, err error) {
+	var addrs [3]string
+	for i := range addrs {
+		for {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				return "", "", "", err
+			}
+			addr := l.Addr().String()
+			udpConn, err := net.ListenPacket("udp", addr)
+			l.Close()
+			if err != nil {
+				continue
+			}
+			udpConn.Close()
+			addrs[i] = addr
+			break
+		}
+	}
+	return addrs[0], addrs[1], addrs[2], nil
+}
+
+func startProcess(dir, path, confName, conf string, verbose bool, output io.Writer) (*exec.Cmd, error) {
+	confPath := filepath.Join(dir, confName)
+	if err := ioutil.WriteFile(confPath, []byte(conf), 0644); err != nil {
+		return nil, err
+	}
+	args := []string{"-conf", confPath}
+	if verbose {
+		args = append(args, "-verbose")
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+func stopProcess(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+	cmd.Wait()
+}
+
+// waitReady queries doh-client until the whole chain answers
+func waitReady(clientAddr string, timeout time.Duration) error {
+	client := &dns.Client{Net: "tcp", Timeout: time.Second}
+	deadline := time.Now().Add(timeout)
+	for {
+		_, _, err := client.Exchange(newQuery("a.test.", dns.TypeA), clientAddr)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("doh-client is not ready after %s: %v", timeout, err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
@@ -0,0 +1,153 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+// Package audit writes an append-only log of changes to the configuration
+// and runtime state, one JSON object per line, so operators can tell who
+// changed what and when.
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"os/user"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is one line of the audit log
+type Entry struct {
+	Time    time.Time              `json:"time"`
+	Event   string                 `json:"event"`
+	Actor   string                 `json:"actor"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// Logger appends entries to an audit log file. A nil *Logger discards
+// everything, so callers don't need to check whether auditing is enabled.
+type Logger struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// Open opens the audit log at path for appending, creating it if necessary.
+// The file is only readable by the owner, since it may reveal the
+// configuration.
+func Open(path string) (*Logger, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Logger{file: file}, nil
+}
+
+// Log appends an entry. Each entry is written with a single write call and
+// synced to disk, so it survives a crash right after the change.
+func (l *Logger) Log(event, actor string, details map[string]interface{}) error {
+	if l == nil {
+		return nil
+	}
+	line, err := json.Marshal(&Entry{
+		Time:    time.Now().UTC(),
+		Event:   event,
+		Actor:   actor,
+		Details: details,
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(line); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// ProcessActor describes the user running this process, e.g.
+// "doh-server (uid 998), pid 1234"
+func ProcessActor() string {
+	var b strings.Builder
+	if u, err := user.Current(); err == nil {
+		b.WriteString(u.Username)
+		b.WriteString(" (uid ")
+		b.WriteString(u.Uid)
+		b.WriteString("), ")
+	}
+	b.WriteString("pid ")
+	b.WriteString(strconv.Itoa(os.Getpid()))
+	return b.String()
+}
+
+// ChangedKeys compares two configuration structs of the same type and returns
+// the TOML keys of the top-level fields which differ
+func ChangedKeys(old, new interface{}) []string {
+	oldValue := reflect.Indirect(reflect.ValueOf(old))
+	newValue := reflect.Indirect(reflect.ValueOf(new))
+	if oldValue.Type() != newValue.Type() || oldValue.Kind() != reflect.Struct {
+		return nil
+	}
+	var keys []string
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := oldValue.Type().Field(i)
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+		if reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			continue
+		}
+		key := strings.SplitN(field.Tag.Get("toml"), ",", 2)[0]
+		if key == "" {
+			key = field.Name
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Added returns the strings in new which are not in old
+func Added(old, new []string) []string {
+	seen := make(map[string]bool, len(old))
+	for _, s := range old {
+		seen[s] = true
+	}
+	var added []string
+	for _, s := range new {
+		if !seen[s] {
+			added = append(added, s)
+		}
+	}
+	return added
+}
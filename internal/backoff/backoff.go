@@ -0,0 +1,118 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+// Package backoff computes delays between retries, with jitter and a cap, and
+// waits for them on a replaceable clock.
+package backoff
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time used to wait. Tests can replace it with a fake
+// clock to control timing.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SystemClock is the Clock backed by the time package.
+var SystemClock Clock = systemClock{}
+
+// Backoff produces a sequence of delays starting at Base and multiplied by
+// Factor (2 if unset) after every attempt, up to Max if it is set. Each delay
+// is randomized by up to Jitter times its value in either direction.
+type Backoff struct {
+	Base   time.Duration
+	Max    time.Duration
+	Factor float64
+	Jitter float64
+	Clock  Clock
+
+	mu      sync.Mutex
+	attempt int
+	rand    *rand.Rand
+}
+
+// Next returns the delay before the next attempt and advances the sequence.
+func (b *Backoff) Next() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	factor := b.Factor
+	if factor < 1 {
+		factor = 2
+	}
+	delay := float64(b.Base) * math.Pow(factor, float64(b.attempt))
+	if b.Max > 0 && delay >= float64(b.Max) {
+		delay = float64(b.Max)
+	} else if factor > 1 && delay < math.MaxInt64/factor {
+		b.attempt++
+	}
+
+	if b.Jitter > 0 {
+		if b.rand == nil {
+			b.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+		}
+		delay += delay * b.Jitter * (2*b.rand.Float64() - 1)
+	}
+	if delay < 0 {
+		delay = 0
+	} else if delay >= math.MaxInt64 {
+		// float64 can't hold MaxInt64 exactly, and converting a float64 out
+		// of range to time.Duration is undefined
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(delay)
+}
+
+// Reset restarts the sequence from Base, e.g. after a successful attempt.
+func (b *Backoff) Reset() {
+	b.mu.Lock()
+	b.attempt = 0
+	b.mu.Unlock()
+}
+
+// Wait sleeps for the next delay. It returns early with the error of ctx if
+// ctx is done first.
+func (b *Backoff) Wait(ctx context.Context) error {
+	clock := b.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	select {
+	case <-clock.After(b.Next()):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,250 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package backoff
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock records the delays waited for. The channels returned by After
+// fire only when fire is true.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	fire   bool
+	delays []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.delays = append(c.delays, d)
+	ch := make(chan time.Time, 1)
+	if c.fire {
+		c.now = c.now.Add(d)
+		ch <- c.now
+	}
+	return ch
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff *Backoff
+		want    []time.Duration
+	}{
+		{
+			name:    "default factor",
+			backoff: &Backoff{Base: time.Second},
+			want:    []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second},
+		},
+		{
+			name:    "factor below 1 means 2",
+			backoff: &Backoff{Base: time.Second, Factor: 0.5},
+			want:    []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second},
+		},
+		{
+			name:    "factor 3",
+			backoff: &Backoff{Base: 100 * time.Millisecond, Factor: 3},
+			want:    []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond},
+		},
+		{
+			name:    "max",
+			backoff: &Backoff{Base: time.Second, Max: 5 * time.Second},
+			want:    []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second},
+		},
+		{
+			name:    "max below base",
+			backoff: &Backoff{Base: 10 * time.Second, Max: 5 * time.Second},
+			want:    []time.Duration{5 * time.Second, 5 * time.Second},
+		},
+		{
+			name:    "constant interval",
+			backoff: &Backoff{Base: 30 * time.Second, Factor: 1},
+			want:    []time.Duration{30 * time.Second, 30 * time.Second, 30 * time.Second},
+		},
+		{
+			name:    "zero base",
+			backoff: &Backoff{},
+			want:    []time.Duration{0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, want := range tt.want {
+				if got := tt.backoff.Next(); got != want {
+					t.Errorf("delay %d = %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNextOverflow(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff *Backoff
+	}{
+		{"no jitter", &Backoff{Base: time.Hour}},
+		{"jitter", &Backoff{Base: time.Hour, Jitter: 1}},
+		{"large factor", &Backoff{Base: time.Hour, Factor: 1e6, Jitter: 0.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			last := time.Duration(0)
+			for i := 0; i < 200; i++ {
+				delay := tt.backoff.Next()
+				if delay < 0 {
+					t.Fatalf("delay %d = %v, overflowed", i, delay)
+				}
+				if tt.backoff.Jitter == 0 && delay < last {
+					t.Fatalf("delay %d = %v, shorter than %v", i, delay, last)
+				}
+				last = delay
+			}
+			if tt.backoff.Jitter == 0 && last < math.MaxInt64/2 {
+				t.Errorf("delay stopped growing at %v", last)
+			}
+		})
+	}
+}
+
+func TestNextJitter(t *testing.T) {
+	tests := []struct {
+		name   string
+		base   time.Duration
+		max    time.Duration
+		factor float64
+		jitter float64
+	}{
+		{"constant", time.Second, 0, 1, 0.1},
+		{"growing", time.Second, 0, 2, 0.5},
+		{"capped", time.Second, 4 * time.Second, 2, 0.25},
+		{"full", time.Second, 0, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Backoff{Base: tt.base, Max: tt.max, Factor: tt.factor, Jitter: tt.jitter}
+			plain := &Backoff{Base: tt.base, Max: tt.max, Factor: tt.factor}
+			varied := false
+			// few enough attempts not to reach the limit of time.Duration
+			for i := 0; i < 30; i++ {
+				delay, nominal := b.Next(), plain.Next()
+				low := time.Duration(float64(nominal) * (1 - tt.jitter))
+				high := time.Duration(float64(nominal) * (1 + tt.jitter))
+				if delay < low || delay > high {
+					t.Fatalf("delay %d = %v, want within [%v, %v]", i, delay, low, high)
+				}
+				if delay != nominal {
+					varied = true
+				}
+			}
+			if !varied {
+				t.Error("jitter had no effect")
+			}
+		})
+	}
+}
+
+func TestReset(t *testing.T) {
+	b := &Backoff{Base: time.Second, Max: time.Minute}
+	for i := 0; i < 10; i++ {
+		b.Next()
+	}
+	if got := b.Next(); got != time.Minute {
+		t.Fatalf("delay before Reset = %v, want %v", got, time.Minute)
+	}
+	b.Reset()
+	for i, want := range []time.Duration{time.Second, 2 * time.Second} {
+		if got := b.Next(); got != want {
+			t.Errorf("delay %d after Reset = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestWait(t *testing.T) {
+	clock := &fakeClock{fire: true}
+	b := &Backoff{Base: time.Second, Factor: 1, Clock: clock}
+	for i := 0; i < 3; i++ {
+		if err := b.Wait(context.Background()); err != nil {
+			t.Fatalf("Wait %d: %v", i, err)
+		}
+	}
+	if len(clock.delays) != 3 {
+		t.Fatalf("waited %d times, want 3", len(clock.delays))
+	}
+	for i, delay := range clock.delays {
+		if delay != time.Second {
+			t.Errorf("wait %d for %v, want %v", i, delay, time.Second)
+		}
+	}
+	if got := clock.Now().Sub(time.Time{}); got != 3*time.Second {
+		t.Errorf("clock advanced by %v, want %v", got, 3*time.Second)
+	}
+}
+
+func TestWaitCanceled(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+		want error
+	}{
+		{"canceled", func() (context.Context, context.CancelFunc) {
+			return context.WithCancel(context.Background())
+		}, context.Canceled},
+		{"deadline", func() (context.Context, context.CancelFunc) {
+			return context.WithDeadline(context.Background(), time.Unix(0, 0))
+		}, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{}
+			b := &Backoff{Base: time.Hour, Clock: clock}
+			ctx, cancel := tt.ctx()
+			done := make(chan error, 1)
+			go func() {
+				done <- b.Wait(ctx)
+			}()
+			cancel()
+			select {
+			case err := <-done:
+				if err != tt.want {
+					t.Errorf("Wait() = %v, want %v", err, tt.want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Wait did not return after ctx was done")
+			}
+		})
+	}
+}
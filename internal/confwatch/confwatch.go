@@ -0,0 +1,124 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+// Package confwatch loads configuration from a file or a directory, such as
+// a mounted Kubernetes ConfigMap, and restarts the program when it changes.
+package confwatch
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Files returns the configuration files at path. If path is a directory, all
+// files ending with .conf or .toml in it are returned in lexical order, so
+// later files override earlier ones. Hidden entries are skipped, which
+// include the "..data" symlink and timestamped directories of ConfigMaps.
+func Files(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if !strings.HasSuffix(name, ".conf") && !strings.HasSuffix(name, ".toml") {
+			continue
+		}
+		files = append(files, filepath.Join(path, name))
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no .conf or .toml file in " + path)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// fingerprint identifies the current content of the configuration at path.
+// ConfigMaps are updated by atomically swapping a symlink, so the resolved
+// path of each file is part of it, not only its size and modification time.
+func fingerprint(path string) string {
+	files, err := Files(path)
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	var b strings.Builder
+	for _, file := range files {
+		resolved, err := filepath.EvalSymlinks(file)
+		if err != nil {
+			fmt.Fprintf(&b, "%s: %v\n", file, err)
+			continue
+		}
+		info, err := os.Stat(resolved)
+		if err != nil {
+			fmt.Fprintf(&b, "%s: %v\n", file, err)
+			continue
+		}
+		fmt.Fprintf(&b, "%s -> %s %d %d\n", file, resolved, info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String()
+}
+
+// Watch polls the configuration at path every interval. When it has changed,
+// validate is called to load it. If it is valid, the program is restarted
+// with the same arguments to apply it, otherwise the error is logged and the
+// current configuration stays in effect. Watch never returns.
+func Watch(path string, interval time.Duration, validate func(path string) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := fingerprint(path)
+	for range ticker.C {
+		current := fingerprint(path)
+		if current == last {
+			continue
+		}
+		last = current
+
+		if err := validate(path); err != nil {
+			log.Printf("Configuration at %s changed, but it is invalid, keeping the current one: %v\n", path, err)
+			continue
+		}
+		log.Printf("Configuration at %s changed, restarting.\n", path)
+		if err := restart(); err != nil {
+			log.Printf("Failed to restart: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package dnsutil
+
+import (
+	"github.com/miekg/dns"
+)
+
+// minimalANYTTL is the TTL of the synthesized HINFO record, long enough for
+// caches to absorb repeated ANY queries
+const minimalANYTTL = 3600
+
+// IsMinimalANYQuery tells whether msg is an ANY query of class IN, which
+// should be answered with MinimalANYAnswer instead of being forwarded.
+func IsMinimalANYQuery(msg *dns.Msg) bool {
+	if len(msg.Question) != 1 {
+		return false
+	}
+	question := &msg.Question[0]
+	return question.Qtype == dns.TypeANY && question.Qclass == dns.ClassINET
+}
+
+// MinimalANYAnswer is the synthesized HINFO record answering an ANY query for
+// name, as described in RFC 8482 section 4.2.
+func MinimalANYAnswer(name string) dns.RR {
+	return &dns.HINFO{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeHINFO,
+			Class:  dns.ClassINET,
+			Ttl:    minimalANYTTL,
+		},
+		Cpu: "RFC8482",
+		Os:  "",
+	}
+}
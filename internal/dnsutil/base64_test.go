@@ -0,0 +1,93 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package dnsutil
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBase64URL(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+		decoded []byte
+	}{
+		{"empty", "", []byte{}},
+		{"one byte", "AA", []byte{0x00}},
+		{"two bytes", "__8", []byte{0xff, 0xff}},
+		{"three bytes", "-_-_", []byte{0xfb, 0xff, 0xbf}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EncodeBase64URL(tt.decoded); got != tt.encoded {
+				t.Errorf("EncodeBase64URL(%x) = %q, want %q", tt.decoded, got, tt.encoded)
+			}
+			got, err := DecodeBase64URL(tt.encoded)
+			if err != nil {
+				t.Fatalf("DecodeBase64URL(%q): %v", tt.encoded, err)
+			}
+			if !bytes.Equal(got, tt.decoded) {
+				t.Errorf("DecodeBase64URL(%q) = %x, want %x", tt.encoded, got, tt.decoded)
+			}
+		})
+	}
+}
+
+func TestDecodeBase64URLPadding(t *testing.T) {
+	tests := []struct {
+		input   string
+		decoded []byte
+	}{
+		{"AA==", []byte{0x00}},
+		{"AA=", []byte{0x00}},
+		{"__8=", []byte{0xff, 0xff}},
+		{"-_-_", []byte{0xfb, 0xff, 0xbf}},
+	}
+	for _, tt := range tests {
+		got, err := DecodeBase64URL(tt.input)
+		if err != nil {
+			t.Errorf("DecodeBase64URL(%q): %v", tt.input, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.decoded) {
+			t.Errorf("DecodeBase64URL(%q) = %x, want %x", tt.input, got, tt.decoded)
+		}
+	}
+}
+
+func TestDecodeBase64URLInvalid(t *testing.T) {
+	tests := []string{
+		"A",        // dangling bits
+		"AA+/",     // standard alphabet
+		"AA AA",    // white space
+		"AA==AA",   // padding in the middle
+		"\x00\x01", // binary
+	}
+	for _, input := range tests {
+		if got, err := DecodeBase64URL(input); err == nil {
+			t.Errorf("DecodeBase64URL(%q) = %x, want error", input, got)
+		}
+	}
+}
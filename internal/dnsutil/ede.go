@@ -0,0 +1,67 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package dnsutil
+
+import (
+	"encoding/binary"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// EDNS0 option code of Extended DNS Errors (RFC 8914)
+const EDNS0EDE = 15
+
+// Extended DNS Error info-codes used by DNS-over-HTTPS
+const (
+	ExtendedErrorOther                = 0
+	ExtendedErrorNoReachableAuthority = 22
+	ExtendedErrorNetworkError         = 23
+)
+
+// SetExtendedError attaches an Extended DNS Error option to msg, adding an OPT
+// record if necessary.
+func SetExtendedError(msg *dns.Msg, infoCode uint16, extraText string) {
+	opt := EnsureOPT(msg)
+	data := make([]byte, 2+len(extraText))
+	binary.BigEndian.PutUint16(data, infoCode)
+	copy(data[2:], extraText)
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+		Code: EDNS0EDE,
+		Data: data,
+	})
+}
+
+// FormatExtendedError converts the data of an Extended DNS Error option into
+// a human-readable comment, e.g. "EDE(22): upstream timed out"
+func FormatExtendedError(data []byte) string {
+	if len(data) < 2 {
+		return ""
+	}
+	comment := "EDE(" + strconv.FormatUint(uint64(binary.BigEndian.Uint16(data)), 10) + ")"
+	if len(data) > 2 {
+		comment += ": " + string(data[2:])
+	}
+	return comment
+}
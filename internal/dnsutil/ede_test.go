@@ -0,0 +1,101 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package dnsutil
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSetExtendedError(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      *dns.Msg
+		infoCode uint16
+		text     string
+		wantData []byte
+	}{
+		{"without OPT", new(dns.Msg), ExtendedErrorNetworkError, "", []byte{0, 23}},
+		{"with text", new(dns.Msg), ExtendedErrorNoReachableAuthority, "timeout", []byte("\x00\x16timeout")},
+		{"existing OPT", &dns.Msg{Extra: []dns.RR{NewOPT(1232, true)}}, 0xffff, "x", []byte("\xff\xffx")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hadOPT := tt.msg.IsEdns0() != nil
+			SetExtendedError(tt.msg, tt.infoCode, tt.text)
+			if len(tt.msg.Extra) != 1 {
+				t.Fatalf("got %d additional records, want 1", len(tt.msg.Extra))
+			}
+			opt := tt.msg.IsEdns0()
+			if opt == nil {
+				t.Fatal("no OPT record")
+			}
+			if hadOPT && (opt.UDPSize() != 1232 || !opt.Do()) {
+				t.Errorf("existing OPT was replaced")
+			}
+			if len(opt.Option) != 1 {
+				t.Fatalf("got %d options, want 1", len(opt.Option))
+			}
+			local, ok := opt.Option[0].(*dns.EDNS0_LOCAL)
+			if !ok || local.Code != EDNS0EDE {
+				t.Fatalf("option is %#v, want EDNS0_LOCAL with code %d", opt.Option[0], EDNS0EDE)
+			}
+			if !bytes.Equal(local.Data, tt.wantData) {
+				t.Errorf("option data = %q, want %q", local.Data, tt.wantData)
+			}
+
+			// the option must be in the wire format as it is, newer versions of
+			// miekg/dns parse it into a different type
+			wire, err := tt.msg.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			option := append([]byte{0, EDNS0EDE, 0, byte(len(tt.wantData))}, tt.wantData...)
+			if !bytes.Contains(wire, option) {
+				t.Errorf("wire format %x does not contain option %x", wire, option)
+			}
+		})
+	}
+}
+
+func TestFormatExtendedError(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want string
+	}{
+		{nil, ""},
+		{[]byte{0}, ""},
+		{[]byte{0, 0}, "EDE(0)"},
+		{[]byte{0, 23}, "EDE(23)"},
+		{[]byte("\x00\x16upstream timed out"), "EDE(22): upstream timed out"},
+		{[]byte{0xff, 0xff}, "EDE(65535)"},
+	}
+	for _, tt := range tests {
+		if got := FormatExtendedError(tt.data); got != tt.want {
+			t.Errorf("FormatExtendedError(%q) = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+// Package dnsutil collects the DNS message manipulation shared by doh-client
+// and doh-server, so that fixes land in one place.
+package dnsutil
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// NewOPT creates an OPT pseudo-record advertising udpSize and the DO bit.
+func NewOPT(udpSize uint16, do bool) *dns.OPT {
+	opt := new(dns.OPT)
+	opt.Hdr.Name = "."
+	opt.Hdr.Rrtype = dns.TypeOPT
+	opt.SetUDPSize(udpSize)
+	opt.SetDo(do)
+	return opt
+}
+
+// EnsureOPT returns the OPT record of msg. If there is none, a new one with
+// the default UDP size and no DO bit is inserted.
+func EnsureOPT(msg *dns.Msg) *dns.OPT {
+	if opt := msg.IsEdns0(); opt != nil {
+		return opt
+	}
+	opt := NewOPT(dns.DefaultMsgSize, false)
+	msg.Extra = append([]dns.RR{opt}, msg.Extra...)
+	return opt
+}
+
+// FindClientSubnet returns the EDNS0-Client-Subnet option in opt, or nil.
+func FindClientSubnet(opt *dns.OPT) *dns.EDNS0_SUBNET {
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if option.Option() == dns.EDNS0SUBNET {
+			return option.(*dns.EDNS0_SUBNET)
+		}
+	}
+	return nil
+}
+
+// DefaultClientNetmask is the source netmask submitted for address when it is
+// not specified: /24 for IPv4 and /56 for IPv6.
+func DefaultClientNetmask(address net.IP) uint8 {
+	if address.To4() != nil {
+		return 24
+	}
+	return 56
+}
+
+// NewClientSubnet creates an EDNS0-Client-Subnet option for address.
+func NewClientSubnet(address net.IP, netmask, scope uint8) *dns.EDNS0_SUBNET {
+	edns0Subnet := new(dns.EDNS0_SUBNET)
+	edns0Subnet.Code = dns.EDNS0SUBNET
+	if ipv4 := address.To4(); ipv4 != nil {
+		edns0Subnet.Family = 1
+		edns0Subnet.Address = ipv4
+	} else {
+		edns0Subnet.Family = 2
+		edns0Subnet.Address = address
+	}
+	edns0Subnet.SourceNetmask = netmask
+	edns0Subnet.SourceScope = scope
+	return edns0Subnet
+}
@@ -0,0 +1,164 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package dnsutil
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestNewOPT(t *testing.T) {
+	tests := []struct {
+		udpSize uint16
+		do      bool
+	}{
+		{512, false},
+		{1232, true},
+		{dns.DefaultMsgSize, false},
+	}
+	for _, tt := range tests {
+		opt := NewOPT(tt.udpSize, tt.do)
+		if opt.Hdr.Name != "." || opt.Hdr.Rrtype != dns.TypeOPT {
+			t.Errorf("NewOPT(%d, %v) header = %v", tt.udpSize, tt.do, opt.Hdr)
+		}
+		if opt.UDPSize() != tt.udpSize || opt.Do() != tt.do {
+			t.Errorf("NewOPT(%d, %v) = size %d, DO %v", tt.udpSize, tt.do, opt.UDPSize(), opt.Do())
+		}
+		if opt.Version() != 0 || opt.ExtendedRcode() != 0 {
+			t.Errorf("NewOPT(%d, %v) has version %d, extended rcode %d", tt.udpSize, tt.do, opt.Version(), opt.ExtendedRcode())
+		}
+	}
+}
+
+func TestEnsureOPT(t *testing.T) {
+	a := &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}}
+
+	msg := &dns.Msg{Extra: []dns.RR{a}}
+	opt := EnsureOPT(msg)
+	if len(msg.Extra) != 2 || msg.Extra[0] != opt || msg.Extra[1] != a {
+		t.Fatalf("EnsureOPT did not prepend the OPT record: %v", msg.Extra)
+	}
+	if opt.UDPSize() != dns.DefaultMsgSize || opt.Do() {
+		t.Errorf("new OPT has size %d, DO %v", opt.UDPSize(), opt.Do())
+	}
+	if again := EnsureOPT(msg); again != opt || len(msg.Extra) != 2 {
+		t.Errorf("EnsureOPT added a second OPT record")
+	}
+}
+
+func TestClientSubnet(t *testing.T) {
+	tests := []struct {
+		name        string
+		address     string
+		netmask     uint8
+		scope       uint8
+		wantFamily  uint16
+		wantNetmask uint8
+	}{
+		{"IPv4", "192.0.2.1", 24, 0, 1, 24},
+		{"IPv4-mapped", "::ffff:192.0.2.1", 32, 0, 1, 32},
+		{"IPv6", "2001:db8::1", 56, 0, 2, 56},
+		{"scope", "2001:db8::1", 48, 48, 2, 48},
+		{"zero netmask", "192.0.2.1", 0, 0, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := net.ParseIP(tt.address)
+			subnet := NewClientSubnet(address, tt.netmask, tt.scope)
+			if subnet.Code != dns.EDNS0SUBNET || subnet.Family != tt.wantFamily {
+				t.Errorf("code %d, family %d, want %d, %d", subnet.Code, subnet.Family, dns.EDNS0SUBNET, tt.wantFamily)
+			}
+			if subnet.SourceNetmask != tt.wantNetmask || subnet.SourceScope != tt.scope {
+				t.Errorf("netmask %d, scope %d, want %d, %d", subnet.SourceNetmask, subnet.SourceScope, tt.wantNetmask, tt.scope)
+			}
+
+			// build a query with the option, then parse it back from the wire
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			opt := EnsureOPT(msg)
+			opt.Option = append(opt.Option, subnet)
+			wire, err := msg.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed := new(dns.Msg)
+			if err := parsed.Unpack(wire); err != nil {
+				t.Fatal(err)
+			}
+			found := FindClientSubnet(parsed.IsEdns0())
+			if found == nil {
+				t.Fatal("FindClientSubnet found no option after unpacking")
+			}
+			if found.Family != tt.wantFamily || found.SourceNetmask != tt.wantNetmask || found.SourceScope != tt.scope {
+				t.Errorf("parsed option = %v", found)
+			}
+			bits := 128
+			if tt.wantFamily == 1 {
+				bits = 32
+			}
+			// only the bits within the netmask are sent
+			masked := address.Mask(net.CIDRMask(int(tt.wantNetmask), bits))
+			if !found.Address.Equal(masked) {
+				t.Errorf("parsed address = %v, want %v", found.Address, masked)
+			}
+		})
+	}
+}
+
+func TestFindClientSubnet(t *testing.T) {
+	subnet := NewClientSubnet(net.ParseIP("192.0.2.0"), 24, 0)
+	tests := []struct {
+		name string
+		opt  *dns.OPT
+		want *dns.EDNS0_SUBNET
+	}{
+		{"nil OPT", nil, nil},
+		{"no options", NewOPT(4096, false), nil},
+		{"other options", &dns.OPT{Option: []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE}}}, nil},
+		{"subnet", &dns.OPT{Option: []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE}, subnet}}, subnet},
+	}
+	for _, tt := range tests {
+		if got := FindClientSubnet(tt.opt); got != tt.want {
+			t.Errorf("%s: FindClientSubnet() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultClientNetmask(t *testing.T) {
+	tests := []struct {
+		address string
+		want    uint8
+	}{
+		{"192.0.2.1", 24},
+		{"::ffff:192.0.2.1", 24},
+		{"2001:db8::1", 56},
+	}
+	for _, tt := range tests {
+		if got := DefaultClientNetmask(net.ParseIP(tt.address)); got != tt.want {
+			t.Errorf("DefaultClientNetmask(%s) = %d, want %d", tt.address, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package dnsutil
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// idnaProfile maps names the way browsers do before lookup (UTS #46), so
+// that case variants, full-width forms and other Unicode lookalikes of a name
+// become the same A-labels. Unlike idna.Lookup, it accepts underscores and
+// other characters outside of host names, which are common in DNS.
+var idnaProfile = idna.New(
+	idna.MapForLookup(),
+	idna.StrictDomainName(false),
+)
+
+// ToASCIIName converts the internationalized labels of name to lower-case
+// A-labels. name may be in presentation format, where the bytes of U-labels
+// received over the wire are escaped as \DDD.
+func ToASCIIName(name string) (string, error) {
+	if name == "" || name == "." {
+		return name, nil
+	}
+	unescaped := unescapeHighBytes(name)
+	if strings.IndexByte(unescaped, '\\') >= 0 || !utf8.ValidString(unescaped) {
+		// escaped dots or binary labels can't be mapped, compare them as they are
+		return strings.ToLower(name), nil
+	}
+	return idnaProfile.ToASCII(unescaped)
+}
+
+// CanonicalName is like ToASCIIName, but falls back to the lower-cased name
+// if it is not a valid internationalized name. It is meant for matching names
+// against rules, where a lookalike encoding must not escape the match.
+func CanonicalName(name string) string {
+	ascii, err := ToASCIIName(name)
+	if err != nil {
+		return strings.ToLower(name)
+	}
+	return ascii
+}
+
+// unescapeHighBytes replaces the \DDD escapes of non-ASCII bytes in name with
+// the bytes themselves, other escapes are kept
+func unescapeHighBytes(name string) string {
+	if strings.IndexByte(name, '\\') < 0 {
+		return name
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' && i+3 < len(name) {
+			if value, err := strconv.ParseUint(name[i+1:i+4], 10, 8); err == nil && value >= 0x80 {
+				b.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		if name[i] == '\\' && i+1 < len(name) {
+			// keep the escape together with the escaped character
+			b.WriteByte(name[i])
+			i++
+		}
+		b.WriteByte(name[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,94 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package dnsutil
+
+import "testing"
+
+func TestToASCIIName(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{".", ".", false},
+		{"example.com.", "example.com.", false},
+		{"EXAMPLE.com.", "example.com.", false},
+		{"_dmarc.example.com.", "_dmarc.example.com.", false},
+		{"bücher.example.", "xn--bcher-kva.example.", false},
+		{"BÜCHER.example.", "xn--bcher-kva.example.", false},
+		{"xn--bcher-kva.example.", "xn--bcher-kva.example.", false},
+		{"ｅｘａｍｐｌｅ.com.", "example.com.", false},
+		{`b\195\188cher.example.`, "xn--bcher-kva.example.", false},
+		{`a\.B.example.`, `a\.b.example.`, false},
+		{`\255\000.example.`, `\255\000.example.`, false},
+		{"xn--a.example.", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ToASCIIName(tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ToASCIIName(%q) error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("ToASCIIName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Example.COM.", "example.com."},
+		{"Bücher.Example.", "xn--bcher-kva.example."},
+		{"XN--A.Example.", "xn--a.example."},
+	}
+	for _, tt := range tests {
+		if got := CanonicalName(tt.name); got != tt.want {
+			t.Errorf("CanonicalName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUnescapeHighBytes(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"example.com.", "example.com."},
+		{`\195\188.example.`, "\xc3\xbc.example."},
+		{`\065.example.`, `\065.example.`},
+		{`a\.b.`, `a\.b.`},
+		{`a\\\200.`, "a\\\\\xc8."},
+		{`trailing\`, `trailing\`},
+		{`short\19`, `short\19`},
+	}
+	for _, tt := range tests {
+		if got := unescapeHighBytes(tt.name); got != tt.want {
+			t.Errorf("unescapeHighBytes(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
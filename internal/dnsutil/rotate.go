@@ -0,0 +1,68 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package dnsutil
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RotateAddresses rotates the records of every A and AAAA RRset in the
+// answer section of msg by n positions, so that clients which always use the
+// first address spread their load over all of them.
+func RotateAddresses(msg *dns.Msg, n uint32) {
+	type rrsetKey struct {
+		name   string
+		rrtype uint16
+	}
+	var keys []rrsetKey
+	rrsets := make(map[rrsetKey][]int)
+	for i, rr := range msg.Answer {
+		rrHeader := rr.Header()
+		if rrHeader.Rrtype != dns.TypeA && rrHeader.Rrtype != dns.TypeAAAA {
+			continue
+		}
+		key := rrsetKey{strings.ToLower(rrHeader.Name), rrHeader.Rrtype}
+		if _, ok := rrsets[key]; !ok {
+			keys = append(keys, key)
+		}
+		rrsets[key] = append(rrsets[key], i)
+	}
+
+	for _, key := range keys {
+		indices := rrsets[key]
+		if len(indices) < 2 {
+			continue
+		}
+		rrs := make([]dns.RR, len(indices))
+		for i, index := range indices {
+			rrs[i] = msg.Answer[index]
+		}
+		shift := int(n % uint32(len(indices)))
+		for i, index := range indices {
+			msg.Answer[index] = rrs[(i+shift)%len(rrs)]
+		}
+	}
+}
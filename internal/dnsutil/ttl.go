@@ -0,0 +1,76 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package dnsutil
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// AdjustTTL decreases the TTL of all records in msg by delta, which is how
+// long the message has been cached, e.g. by an HTTP cache.
+func AdjustTTL(msg *dns.Msg, delta time.Duration) {
+	for _, rr := range msg.Answer {
+		adjustRecordTTL(rr, delta)
+	}
+	for _, rr := range msg.Ns {
+		adjustRecordTTL(rr, delta)
+	}
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		adjustRecordTTL(rr, delta)
+	}
+}
+
+func adjustRecordTTL(rr dns.RR, delta time.Duration) {
+	rrHeader := rr.Header()
+	oldTTL := time.Duration(rrHeader.Ttl) * time.Second
+	newTTL := oldTTL - delta
+	if newTTL > 0 {
+		rrHeader.Ttl = uint32(newTTL / time.Second)
+	} else {
+		rrHeader.Ttl = 0
+	}
+}
+
+// LeastTTL returns the smallest TTL of all records in msg, except OPT. The
+// second return value is false if there are no such records.
+func LeastTTL(msg *dns.Msg) (ttl uint32, ok bool) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			rrHeader := rr.Header()
+			if rrHeader.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !ok || rrHeader.Ttl < ttl {
+				ttl = rrHeader.Ttl
+				ok = true
+			}
+		}
+	}
+	return
+}
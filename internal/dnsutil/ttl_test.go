@@ -0,0 +1,106 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package dnsutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTTLMsg(ttl uint32) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}}}
+	msg.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl}, Ns: "ns.example.com."}}
+	msg.Extra = []dns.RR{
+		NewOPT(4096, true),
+		&dns.A{Hdr: dns.RR_Header{Name: "ns.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}},
+	}
+	return msg
+}
+
+func TestAdjustTTL(t *testing.T) {
+	tests := []struct {
+		name  string
+		ttl   uint32
+		delta time.Duration
+		want  uint32
+	}{
+		{"no change", 300, 0, 300},
+		{"decrement", 300, 100 * time.Second, 200},
+		{"partial second", 300, 1500 * time.Millisecond, 298},
+		{"expires exactly", 300, 300 * time.Second, 0},
+		{"clamped at zero", 300, time.Hour, 0},
+		{"zero stays zero", 0, time.Second, 0},
+		{"largest ttl", 0xffffffff, 0, 0xffffffff},
+		{"largest ttl decrement", 0xffffffff, time.Second, 0xfffffffe},
+		{"negative delta", 100, -10 * time.Second, 110},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := newTTLMsg(tt.ttl)
+			opt := msg.IsEdns0()
+			optTTL := opt.Hdr.Ttl
+			AdjustTTL(msg, tt.delta)
+			for _, rr := range append(append(msg.Answer, msg.Ns...), msg.Extra[1:]...) {
+				if got := rr.Header().Ttl; got != tt.want {
+					t.Errorf("TTL of %s = %d, want %d", dns.TypeToString[rr.Header().Rrtype], got, tt.want)
+				}
+			}
+			if opt.Hdr.Ttl != optTTL {
+				t.Errorf("TTL of OPT changed from %#x to %#x", optTTL, opt.Hdr.Ttl)
+			}
+		})
+	}
+}
+
+func TestLeastTTL(t *testing.T) {
+	rr := func(ttl uint32) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}}
+	}
+	opt := NewOPT(4096, true) // the extended rcode and flags are in the TTL of OPT
+	tests := []struct {
+		name   string
+		msg    *dns.Msg
+		want   uint32
+		wantOK bool
+	}{
+		{"empty", &dns.Msg{}, 0, false},
+		{"only OPT", &dns.Msg{Extra: []dns.RR{opt}}, 0, false},
+		{"answer", &dns.Msg{Answer: []dns.RR{rr(300), rr(60)}}, 60, true},
+		{"authority", &dns.Msg{Answer: []dns.RR{rr(300)}, Ns: []dns.RR{rr(30)}}, 30, true},
+		{"additional", &dns.Msg{Answer: []dns.RR{rr(300)}, Extra: []dns.RR{opt, rr(10)}}, 10, true},
+		{"zero", &dns.Msg{Answer: []dns.RR{rr(300), rr(0)}}, 0, true},
+		{"largest", &dns.Msg{Answer: []dns.RR{rr(0xffffffff)}}, 0xffffffff, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := LeastTTL(tt.msg)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("LeastTTL() = %d, %v, want %d, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
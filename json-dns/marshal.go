@@ -29,6 +29,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/m13253/dns-over-https/internal/dnsutil"
 	"github.com/miekg/dns"
 )
 
@@ -91,6 +92,13 @@ func Marshal(msg *dns.Msg) *Response {
 						clientAddress = ipv4
 					}
 					resp.EdnsClientSubnet = clientAddress.String() + "/" + strconv.FormatUint(uint64(edns0.SourceScope), 10)
+				} else if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == dnsutil.EDNS0EDE {
+					if comment := dnsutil.FormatExtendedError(local.Data); comment != "" {
+						if resp.Comment != "" {
+							resp.Comment += "; "
+						}
+						resp.Comment += comment
+					}
 				}
 			}
 			continue
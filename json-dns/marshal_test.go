@@ -0,0 +1,263 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package jsonDNS_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/m13253/dns-over-https/internal/dnsutil"
+	"github.com/m13253/dns-over-https/json-dns"
+	"github.com/miekg/dns"
+)
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// TestJSONRoundTrip converts wire-format responses to JSON and back, the same
+// way doh-server and doh-client do for the Google-compatible protocol.
+func TestJSONRoundTrip(t *testing.T) {
+	now := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		rcode   int
+		flags   func(msg *dns.Msg)
+		answer  []string
+		ns      []string
+		extra   []string
+		ecs     *dns.EDNS0_SUBNET
+		netmask uint8
+	}{
+		{
+			name:   "A",
+			qname:  "example.com.",
+			qtype:  dns.TypeA,
+			answer: []string{"example.com. 300 IN A 192.0.2.1", "example.com. 60 IN A 192.0.2.2"},
+		},
+		{
+			name:   "CNAME and AAAA",
+			qname:  "www.example.com.",
+			qtype:  dns.TypeAAAA,
+			answer: []string{"www.example.com. 3600 IN CNAME example.com.", "example.com. 300 IN AAAA 2001:db8::1"},
+		},
+		{
+			name:  "NXDOMAIN",
+			qname: "nx.example.com.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+			ns:    []string{"example.com. 900 IN SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 900"},
+		},
+		{
+			name:  "flags",
+			qname: "example.com.",
+			qtype: dns.TypeTXT,
+			flags: func(msg *dns.Msg) {
+				msg.AuthenticatedData = true
+				msg.CheckingDisabled = true
+				msg.Truncated = true
+			},
+			answer: []string{`example.com. 300 IN TXT "v=spf1 -all"`},
+		},
+		{
+			name:   "additional",
+			qname:  "example.com.",
+			qtype:  dns.TypeMX,
+			answer: []string{"example.com. 300 IN MX 10 mail.example.com."},
+			extra:  []string{"mail.example.com. 300 IN A 192.0.2.25"},
+		},
+		{
+			name:    "client subnet",
+			qname:   "example.com.",
+			qtype:   dns.TypeA,
+			answer:  []string{"example.com. 300 IN A 192.0.2.1"},
+			ecs:     dnsutil.NewClientSubnet(net.ParseIP("198.51.100.0"), 24, 24),
+			netmask: 24,
+		},
+		{
+			name:    "zero TTL",
+			qname:   "example.com.",
+			qtype:   dns.TypeA,
+			answer:  []string{"example.com. 0 IN A 192.0.2.1"},
+			netmask: 255,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(tt.qname, tt.qtype)
+
+			msg := new(dns.Msg)
+			msg.SetRcode(req, tt.rcode)
+			msg.RecursionAvailable = true
+			if tt.flags != nil {
+				tt.flags(msg)
+			}
+			for _, s := range tt.answer {
+				msg.Answer = append(msg.Answer, mustRR(t, s))
+			}
+			for _, s := range tt.ns {
+				msg.Ns = append(msg.Ns, mustRR(t, s))
+			}
+			opt := dnsutil.NewOPT(4096, false)
+			if tt.ecs != nil {
+				opt.Option = append(opt.Option, tt.ecs)
+			}
+			msg.Extra = append(msg.Extra, opt)
+			for _, s := range tt.extra {
+				msg.Extra = append(msg.Extra, mustRR(t, s))
+			}
+
+			resp := jsonDNS.Marshal(msg)
+			if resp.Status != uint32(tt.rcode) {
+				t.Errorf("Status = %d, want %d", resp.Status, tt.rcode)
+			}
+			if len(resp.Question) != 1 || resp.Question[0].Name != tt.qname || resp.Question[0].Type != tt.qtype {
+				t.Errorf("Question = %v", resp.Question)
+			}
+			if len(resp.Additional) != len(tt.extra) {
+				t.Errorf("Additional has %d records, want %d without OPT", len(resp.Additional), len(tt.extra))
+			}
+			if tt.ecs != nil && resp.EdnsClientSubnet != "198.51.100.0/24" {
+				t.Errorf("edns_client_subnet = %q", resp.EdnsClientSubnet)
+			}
+			if ttl, ok := dnsutil.LeastTTL(msg); ok != resp.HaveTTL || ttl != resp.LeastTTL {
+				t.Errorf("LeastTTL = %d, %v, want %d, %v", resp.LeastTTL, resp.HaveTTL, ttl, ok)
+			}
+
+			// the expire times are rounded to seconds in JSON, so convert
+			// them back at the time they were calculated from
+			for _, section := range [][]jsonDNS.RR{resp.Answer, resp.Authority, resp.Additional} {
+				for i := range section {
+					section[i].ExpiresStr = now.Add(time.Duration(section[i].TTL) * time.Second).Format(time.RFC1123)
+				}
+			}
+			reply := jsonDNS.UnmarshalAt(req, resp, 4096, tt.netmask, now)
+
+			if reply.Id != req.Id || reply.Rcode != tt.rcode {
+				t.Errorf("reply id %d, rcode %d, want %d, %d", reply.Id, reply.Rcode, req.Id, tt.rcode)
+			}
+			if reply.AuthenticatedData != msg.AuthenticatedData || reply.CheckingDisabled != msg.CheckingDisabled || reply.Truncated != msg.Truncated {
+				t.Errorf("reply flags AD %v, CD %v, TC %v", reply.AuthenticatedData, reply.CheckingDisabled, reply.Truncated)
+			}
+			compareRRs(t, "answer", reply.Answer, msg.Answer)
+			compareRRs(t, "authority", reply.Ns, msg.Ns)
+			if len(reply.Extra) == 0 || reply.Extra[0].Header().Rrtype != dns.TypeOPT {
+				t.Fatalf("reply has no leading OPT record: %v", reply.Extra)
+			}
+			compareRRs(t, "additional", reply.Extra[1:], msg.Extra[1:])
+
+			subnet := dnsutil.FindClientSubnet(reply.IsEdns0())
+			if tt.ecs == nil {
+				if subnet != nil {
+					t.Errorf("unexpected client subnet %v", subnet)
+				}
+			} else if subnet == nil {
+				t.Error("client subnet lost")
+			} else if !subnet.Address.Equal(tt.ecs.Address) || subnet.SourceNetmask != tt.netmask || subnet.SourceScope != tt.ecs.SourceScope {
+				t.Errorf("client subnet = %v, want %v", subnet, tt.ecs)
+			}
+
+			if _, err := reply.Pack(); err != nil {
+				t.Errorf("reply can't be packed: %v", err)
+			}
+		})
+	}
+}
+
+func compareRRs(t *testing.T, section string, got, want []dns.RR) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s has %d records, want %d", section, len(got), len(want))
+		return
+	}
+	for i := range got {
+		if !dns.IsDuplicate(got[i], want[i]) || got[i].Header().Ttl != want[i].Header().Ttl {
+			t.Errorf("%s[%d] = %v, want %v", section, i, got[i], want[i])
+		}
+	}
+}
+
+// TestJSONExtendedError checks that Extended DNS Errors show up as comments in
+// JSON responses.
+func TestJSONExtendedError(t *testing.T) {
+	tests := []struct {
+		codes []uint16
+		texts []string
+		want  string
+	}{
+		{nil, nil, ""},
+		{[]uint16{dnsutil.ExtendedErrorNetworkError}, []string{""}, "EDE(23)"},
+		{[]uint16{dnsutil.ExtendedErrorNoReachableAuthority}, []string{"timeout"}, "EDE(22): timeout"},
+		{[]uint16{22, 0}, []string{"a", "b"}, "EDE(22): a; EDE(0): b"},
+	}
+	for _, tt := range tests {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.Response = true
+		for i, code := range tt.codes {
+			dnsutil.SetExtendedError(msg, code, tt.texts[i])
+		}
+		if got := jsonDNS.Marshal(msg).Comment; got != tt.want {
+			t.Errorf("Comment = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+// TestJSONInvalidRecords checks that records which can't be converted back
+// to the wire format are dropped.
+func TestJSONInvalidRecords(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp := &jsonDNS.Response{
+		Question: []jsonDNS.Question{{Name: "example.com.", Type: dns.TypeA}},
+		Answer: []jsonDNS.RR{
+			{Question: jsonDNS.Question{Name: "example.com.", Type: dns.TypeA}, TTL: 300, Data: "192.0.2.1"},
+			{Question: jsonDNS.Question{Name: "exa mple.com.", Type: dns.TypeA}, TTL: 300, Data: "192.0.2.2"},
+			{Question: jsonDNS.Question{Name: "example.com.", Type: 65280}, TTL: 300, Data: "x"},
+			{Question: jsonDNS.Question{Name: "example.com.", Type: dns.TypeTXT}, TTL: 300, Data: "\"a\nb\""},
+			{Question: jsonDNS.Question{Name: "example.com.", Type: dns.TypeA}, TTL: 300, ExpiresStr: "tomorrow", Data: "192.0.2.3"},
+			{Question: jsonDNS.Question{Name: "example.com.", Type: dns.TypeA}, TTL: 300, Data: "not an address"},
+		},
+		EdnsClientSubnet: "not a subnet",
+	}
+	reply := jsonDNS.Unmarshal(req, resp, 0, 255)
+	if len(reply.Answer) != 1 || reply.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("Answer = %v, want only 192.0.2.1", reply.Answer)
+	}
+	opt := reply.IsEdns0()
+	if opt == nil || opt.UDPSize() != 512 {
+		t.Errorf("OPT = %v, want UDP size raised to 512", opt)
+	}
+	if subnet := dnsutil.FindClientSubnet(opt); subnet != nil {
+		t.Errorf("invalid client subnet was kept: %v", subnet)
+	}
+}
@@ -21,6 +21,10 @@
    DEALINGS IN THE SOFTWARE.
 */
 
+// Package jsonDNS converts between DNS messages and the JSON format of the
+// Google DNS-over-HTTPS API. It is the one implementation of the conversion
+// shared by doh-client and doh-server, the other message helpers they share
+// are in internal/dnsutil.
 package jsonDNS
 
 import (
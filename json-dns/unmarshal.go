@@ -31,6 +31,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/m13253/dns-over-https/internal/dnsutil"
 	"github.com/miekg/dns"
 )
 
@@ -50,8 +51,14 @@ func PrepareReply(req *dns.Msg) *dns.Msg {
 }
 
 func Unmarshal(msg *dns.Msg, resp *Response, udpSize uint16, ednsClientNetmask uint8) *dns.Msg {
-	now := time.Now().UTC()
+	return UnmarshalAt(msg, resp, udpSize, ednsClientNetmask, time.Now().UTC())
+}
 
+// UnmarshalAt is like Unmarshal, but computes the TTL of records from their
+// absolute expire time as if the current time is now.
+// Passing the Date header of the HTTP response makes the TTL independent of
+// the local clock, which may be wrong just after resuming from sleep.
+func UnmarshalAt(msg *dns.Msg, resp *Response, udpSize uint16, ednsClientNetmask uint8, now time.Time) *dns.Msg {
 	reply := msg.Copy()
 	reply.Truncated = resp.TC
 	reply.AuthenticatedData = resp.AD
@@ -79,17 +86,11 @@ func Unmarshal(msg *dns.Msg, resp *Response, udpSize uint16, ednsClientNetmask u
 	}
 
 	reply.Extra = make([]dns.RR, 0, len(resp.Additional)+1)
-	opt := new(dns.OPT)
-	opt.Hdr.Name = "."
-	opt.Hdr.Rrtype = dns.TypeOPT
-	if udpSize >= 512 {
-		opt.SetUDPSize(udpSize)
-	} else {
-		opt.SetUDPSize(512)
+	if udpSize < 512 {
+		udpSize = 512
 	}
-	opt.SetDo(false)
+	opt := dnsutil.NewOPT(udpSize, false)
 	ednsClientSubnet := resp.EdnsClientSubnet
-	ednsClientFamily := uint16(0)
 	ednsClientAddress := net.IP(nil)
 	ednsClientScope := uint8(255)
 	if ednsClientSubnet != "" {
@@ -100,11 +101,6 @@ func Unmarshal(msg *dns.Msg, resp *Response, udpSize uint16, ednsClientNetmask u
 			ednsClientAddress = net.ParseIP(ednsClientSubnet[:slash])
 			if ednsClientAddress == nil {
 				log.Println(UnmarshalError{"Invalid client subnet address"})
-			} else if ipv4 := ednsClientAddress.To4(); ipv4 != nil {
-				ednsClientFamily = 1
-				ednsClientAddress = ipv4
-			} else {
-				ednsClientFamily = 2
 			}
 			scope, err := strconv.ParseUint(ednsClientSubnet[slash+1:], 10, 8)
 			if err != nil {
@@ -116,19 +112,9 @@ func Unmarshal(msg *dns.Msg, resp *Response, udpSize uint16, ednsClientNetmask u
 	}
 	if ednsClientAddress != nil {
 		if ednsClientNetmask == 255 {
-			if ednsClientFamily == 1 {
-				ednsClientNetmask = 24
-			} else {
-				ednsClientNetmask = 56
-			}
+			ednsClientNetmask = dnsutil.DefaultClientNetmask(ednsClientAddress)
 		}
-		edns0Subnet := new(dns.EDNS0_SUBNET)
-		edns0Subnet.Code = dns.EDNS0SUBNET
-		edns0Subnet.Family = ednsClientFamily
-		edns0Subnet.SourceNetmask = ednsClientNetmask
-		edns0Subnet.SourceScope = ednsClientScope
-		edns0Subnet.Address = ednsClientAddress
-		opt.Option = append(opt.Option, edns0Subnet)
+		opt.Option = append(opt.Option, dnsutil.NewClientSubnet(ednsClientAddress, ednsClientNetmask, ednsClientScope))
 	}
 	reply.Extra = append(reply.Extra, opt)
 	for _, rr := range resp.Additional {
@@ -0,0 +1,201 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+// Package metrics implements a minimal set of counters and gauges which can be
+// scraped by Prometheus, without depending on the Prometheus client library.
+package metrics
+
+import (
+	"bufio"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type metricType string
+
+const (
+	counterType metricType = "counter"
+	gaugeType   metricType = "gauge"
+)
+
+// Registry holds a set of metrics and renders them in the Prometheus text
+// exposition format.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+// DefaultRegistry is the registry used by NewCounter, NewGauge and Handler.
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return new(Registry)
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+}
+
+type metric struct {
+	name       string
+	help       string
+	typ        metricType
+	labelNames []string
+	mu         sync.Mutex
+	series     map[string]*series
+}
+
+func (r *Registry) register(name, help string, typ metricType, labelNames []string) *metric {
+	m := &metric{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		series:     make(map[string]*series),
+	}
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+	return m
+}
+
+func (m *metric) get(labelValues []string) *series {
+	if len(labelValues) != len(m.labelNames) {
+		panic("metrics: " + m.name + ": wrong number of label values")
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{
+			labelValues: append([]string(nil), labelValues...),
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Counter is a monotonically increasing value, partitioned by label values.
+type Counter struct {
+	m *metric
+}
+
+// NewCounter registers a counter to the DefaultRegistry.
+func NewCounter(name, help string, labelNames ...string) *Counter {
+	return DefaultRegistry.NewCounter(name, help, labelNames...)
+}
+
+func (r *Registry) NewCounter(name, help string, labelNames ...string) *Counter {
+	return &Counter{r.register(name, help, counterType, labelNames)}
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("metrics: " + c.m.name + ": counter cannot decrease")
+	}
+	c.m.mu.Lock()
+	c.m.get(labelValues).value += delta
+	c.m.mu.Unlock()
+}
+
+// Gauge is a value that can go up and down, partitioned by label values.
+type Gauge struct {
+	m *metric
+}
+
+// NewGauge registers a gauge to the DefaultRegistry.
+func NewGauge(name, help string, labelNames ...string) *Gauge {
+	return DefaultRegistry.NewGauge(name, help, labelNames...)
+}
+
+func (r *Registry) NewGauge(name, help string, labelNames ...string) *Gauge {
+	return &Gauge{r.register(name, help, gaugeType, labelNames)}
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.m.mu.Lock()
+	g.m.get(labelValues).value = value
+	g.m.mu.Unlock()
+}
+
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.m.mu.Lock()
+	g.m.get(labelValues).value += delta
+	g.m.mu.Unlock()
+}
+
+var labelValueEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// Handler serves the metrics in the DefaultRegistry.
+func Handler() http.Handler {
+	return DefaultRegistry
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	r.mu.Lock()
+	metrics := append([]*metric(nil), r.metrics...)
+	r.mu.Unlock()
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	bw.Flush()
+}
+
+func (m *metric) write(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.series) == 0 {
+		return
+	}
+	w.WriteString("# HELP " + m.name + " " + strings.Replace(m.help, "\n", " ", -1) + "\n")
+	w.WriteString("# TYPE " + m.name + " " + string(m.typ) + "\n")
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		w.WriteString(m.name)
+		if len(m.labelNames) != 0 {
+			w.WriteByte('{')
+			for i, labelName := range m.labelNames {
+				if i != 0 {
+					w.WriteByte(',')
+				}
+				w.WriteString(labelName + "=\"" + labelValueEscaper.Replace(s.labelValues[i]) + "\"")
+			}
+			w.WriteByte('}')
+		}
+		w.WriteString(" " + strconv.FormatFloat(s.value, 'g', -1, 64) + "\n")
+	}
+}
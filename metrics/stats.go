@@ -0,0 +1,103 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package metrics
+
+import (
+	"time"
+
+	"github.com/m13253/dns-over-https/stats"
+	"github.com/miekg/dns"
+)
+
+// Stats exports the events of stats.Stats as Prometheus metrics.
+type Stats struct {
+	queries         *Counter
+	cacheHits       *Counter
+	upstreamResults *Counter
+	upstreamSeconds *Counter
+	blocked         *Counter
+}
+
+var _ stats.Stats = (*Stats)(nil)
+
+// NewStats registers the metrics of a Stats to the DefaultRegistry, every
+// metric name starts with namespace.
+func NewStats(namespace string) *Stats {
+	return DefaultRegistry.NewStats(namespace)
+}
+
+func (r *Registry) NewStats(namespace string) *Stats {
+	return &Stats{
+		queries: r.NewCounter(
+			namespace+"_queries_total",
+			"Number of queries received from clients.",
+			"qtype"),
+		cacheHits: r.NewCounter(
+			namespace+"_cache_hits_total",
+			"Number of queries answered from the local cache.",
+			"qtype"),
+		upstreamResults: r.NewCounter(
+			namespace+"_upstream_requests_total",
+			"Number of requests sent to each upstream, by result.",
+			"upstream", "result"),
+		upstreamSeconds: r.NewCounter(
+			namespace+"_upstream_request_seconds_total",
+			"Total time spent waiting for successful upstream responses.",
+			"upstream"),
+		blocked: r.NewCounter(
+			namespace+"_blocked_queries_total",
+			"Number of queries refused or dropped instead of being forwarded.",
+			"reason"),
+	}
+}
+
+func (s *Stats) OnQuery(qtype uint16) {
+	s.queries.Inc(qtypeLabel(qtype))
+}
+
+func (s *Stats) OnCacheHit(qtype uint16) {
+	s.cacheHits.Inc(qtypeLabel(qtype))
+}
+
+func (s *Stats) OnUpstreamResult(upstream string, ok bool, latency time.Duration) {
+	if !ok {
+		s.upstreamResults.Inc(upstream, "failure")
+		return
+	}
+	s.upstreamResults.Inc(upstream, "success")
+	s.upstreamSeconds.Add(latency.Seconds(), upstream)
+}
+
+func (s *Stats) OnBlock(qtype uint16, reason string) {
+	s.blocked.Inc(reason)
+}
+
+// qtypeLabel keeps the number of label values bounded, unknown types from
+// clients are counted together
+func qtypeLabel(qtype uint16) string {
+	if name, ok := dns.TypeToString[qtype]; ok {
+		return name
+	}
+	return "other"
+}
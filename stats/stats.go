@@ -0,0 +1,88 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+// Package stats defines the hooks through which DNS-over-HTTPS front-ends
+// report what they are doing. Embedders can implement Stats to feed their own
+// metrics system, the metrics package provides a Prometheus implementation.
+package stats
+
+import "time"
+
+// Stats receives events from a DNS-over-HTTPS front-end. The methods are
+// called concurrently from every query goroutine and must not block.
+type Stats interface {
+	// OnQuery is called for every query received from a client
+	OnQuery(qtype uint16)
+
+	// OnCacheHit is called when a query is answered from a local cache,
+	// without asking any upstream. doh-client has no cache yet and never
+	// calls it, it is here so that sinks don't break once there is one.
+	OnCacheHit(qtype uint16)
+
+	// OnUpstreamResult is called when an upstream request finished, latency
+	// is the time until the response headers arrived
+	OnUpstreamResult(upstream string, ok bool, latency time.Duration)
+
+	// OnBlock is called when a query is refused or dropped instead of
+	// being forwarded, reason is a short machine-readable string
+	OnBlock(qtype uint16, reason string)
+}
+
+// Nop discards every event, it can be embedded to implement only some hooks.
+type Nop struct{}
+
+func (Nop) OnQuery(qtype uint16)                                             {}
+func (Nop) OnCacheHit(qtype uint16)                                          {}
+func (Nop) OnUpstreamResult(upstream string, ok bool, latency time.Duration) {}
+func (Nop) OnBlock(qtype uint16, reason string)                              {}
+
+type multi []Stats
+
+// Multi returns a Stats which passes every event to all of s in order.
+func Multi(s ...Stats) Stats {
+	return multi(s)
+}
+
+func (m multi) OnQuery(qtype uint16) {
+	for _, s := range m {
+		s.OnQuery(qtype)
+	}
+}
+
+func (m multi) OnCacheHit(qtype uint16) {
+	for _, s := range m {
+		s.OnCacheHit(qtype)
+	}
+}
+
+func (m multi) OnUpstreamResult(upstream string, ok bool, latency time.Duration) {
+	for _, s := range m {
+		s.OnUpstreamResult(upstream, ok, latency)
+	}
+}
+
+func (m multi) OnBlock(qtype uint16, reason string) {
+	for _, s := range m {
+		s.OnBlock(qtype, reason)
+	}
+}